@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// deny and allow lists
+//
+// Each list is a text file with one entry per line:
+//
+//	# comments start with a hash
+//	some-account
+//	some-account/some-repo
+//	installation:12345
+//
+// The files are re-read when they change on disk or when the server gets a
+// SIGHUP, so an account can be blocked without a restart.
+
+// AccessList is a set of accounts, repos, and installations loaded from a file.
+type AccessList struct {
+	path string
+
+	mu            sync.RWMutex
+	modTime       time.Time
+	accounts      map[string]bool
+	repos         map[string]bool
+	installations map[int64]bool
+}
+
+func loadAccessList(path string) (*AccessList, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	l := &AccessList{path: path}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// parseAccessList reads a list in the format above; name is used in errors.
+func parseAccessList(r io.Reader, name string) (accounts, repos map[string]bool, installations map[int64]bool, err error) {
+	accounts = make(map[string]bool)
+	repos = make(map[string]bool)
+	installations = make(map[int64]bool)
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.ToLower(strings.TrimSpace(line))
+		if line == "" {
+			continue
+		}
+		if id, ok := strings.CutPrefix(line, "installation:"); ok {
+			n, err := strconv.ParseInt(strings.TrimSpace(id), 10, 64)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("%s:%d: invalid installation id %q", name, lineNum, id)
+			}
+			installations[n] = true
+			continue
+		}
+		if strings.Contains(line, "/") {
+			repos[line] = true
+			continue
+		}
+		accounts[line] = true
+	}
+	return accounts, repos, installations, scanner.Err()
+}
+
+// Reload re-reads the list from disk. On error the previous contents are kept
+// (but the file isn't considered changed again until it's edited, so a bad
+// entry is only reported once).
+func (l *AccessList) Reload() error {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	accounts, repos, installations, err := parseAccessList(f, l.path)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.modTime = fi.ModTime()
+	if err != nil {
+		return err
+	}
+	l.accounts = accounts
+	l.repos = repos
+	l.installations = installations
+	return nil
+}
+
+func (l *AccessList) changed() bool {
+	fi, err := os.Stat(l.path)
+	if err != nil {
+		return false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return !fi.ModTime().Equal(l.modTime)
+}
+
+// Matches reports whether any of the account, repo (owner/name), or
+// installation is in the list.
+func (l *AccessList) Matches(account string, repo string, installation int64) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.accounts[strings.ToLower(account)] ||
+		l.repos[strings.ToLower(repo)] ||
+		l.installations[installation]
+}
+
+// AccessPolicy combines the deny list with an optional allow list (for
+// private deployments, where only listed accounts are served).
+type AccessPolicy struct {
+	Deny  *AccessList
+	Allow *AccessList
+}
+
+func (p *AccessPolicy) lists() []*AccessList {
+	lists := []*AccessList{p.Deny}
+	if p.Allow != nil {
+		lists = append(lists, p.Allow)
+	}
+	return lists
+}
+
+func (p *AccessPolicy) Denied(account string, repo string, installation int64) bool {
+	if p.Deny.Matches(account, repo, installation) {
+		return true
+	}
+	if p.Allow != nil && !p.Allow.Matches(account, repo, installation) {
+		return true
+	}
+	return false
+}
+
+func (p *AccessPolicy) reload(force bool) {
+	for _, l := range p.lists() {
+		if !force && !l.changed() {
+			continue
+		}
+		if err := l.Reload(); err != nil {
+			slog.Error("reloading access list",
+				slog.String("path", l.path),
+				slog.String("error", err.Error()))
+			continue
+		}
+		slog.Info("reloaded access list", slog.String("path", l.path))
+	}
+}
+
+// watch reloads the lists when they change on disk (checking every interval)
+// or when the process receives SIGHUP.
+func (p *AccessPolicy) watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(interval)
+	go func() {
+		for {
+			select {
+			case <-hup:
+				p.reload(true)
+			case <-ticker.C:
+				p.reload(false)
+			}
+		}
+	}()
+}
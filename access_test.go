@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessListMatches(t *testing.T) {
+	list := `# blocked for spam
+Spammer
+alice/Proj   # just this repo
+installation: 42
+`
+	accounts, repos, installations, err := parseAccessList(strings.NewReader(list), "deny-accounts.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &AccessList{accounts: accounts, repos: repos, installations: installations}
+	tests := []struct {
+		name         string
+		account      string
+		repo         string
+		installation int64
+		want         bool
+	}{
+		{"account", "spammer", "spammer/anything", 1, true},
+		{"account is case insensitive", "SPAMMER", "SPAMMER/x", 1, true},
+		{"repo", "alice", "alice/proj", 1, true},
+		{"other repo of the same owner", "alice", "alice/other", 1, false},
+		{"installation", "carol", "carol/proj", 42, true},
+		{"comment is not an entry", "blocked", "blocked/x", 1, false},
+		{"unlisted", "bob", "bob/proj", 7, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := l.Matches(tt.account, tt.repo, tt.installation); got != tt.want {
+				t.Errorf("Matches(%q, %q, %d) = %v, want %v", tt.account, tt.repo, tt.installation, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccessListInvalid(t *testing.T) {
+	_, _, _, err := parseAccessList(strings.NewReader("ok\ninstallation:abc\n"), "deny-accounts.txt")
+	if err == nil || !strings.Contains(err.Error(), "deny-accounts.txt:2") {
+		t.Fatalf("got error %v, want one for line 2", err)
+	}
+}
+
+func TestAccessListReloadError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deny-accounts.txt")
+	if err := os.WriteFile(path, []byte("spammer\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := loadAccessList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("installation:abc\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Reload(); err == nil {
+		t.Fatal("reloading an invalid list succeeded")
+	}
+	if l.changed() {
+		t.Error("invalid list is still considered changed, so it would be reloaded (and logged) again")
+	}
+	if !l.Matches("spammer", "spammer/x", 1) {
+		t.Error("invalid list replaced the previous entries")
+	}
+}
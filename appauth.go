@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/bradleyfalzon/ghinstallation/v2"
+	"github.com/google/go-github/v62/github"
+)
+
+// authenticating as the GitHub App
+
+// installationTransports caches one transport per installation. Each
+// transport holds its installation token and only mints a new one when the
+// current one is close to expiring, so pushes don't each create a token.
+type installationTransports struct {
+	base http.RoundTripper
+
+	mu         sync.Mutex
+	transports map[int64]*ghinstallation.Transport
+}
+
+func newInstallationTransports(base http.RoundTripper) *installationTransports {
+	return &installationTransports{
+		base:       base,
+		transports: make(map[int64]*ghinstallation.Transport),
+	}
+}
+
+func (c *installationTransports) get(installation int64) (*ghinstallation.Transport, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if itr, ok := c.transports[installation]; ok {
+		return itr, nil
+	}
+	itr, err := ghinstallation.New(c.base, Cfg.AppId, installation, Cfg.AppPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	itr.BaseURL = Cfg.APIBaseURL()
+	c.transports[installation] = itr
+	return itr, nil
+}
+
+// newGitHubClient creates an API client for github.com or the configured
+// GitHub Enterprise Server.
+func newGitHubClient(transport http.RoundTripper) (*github.Client, error) {
+	client := github.NewClient(&http.Client{Transport: transport})
+	if Cfg.GitHubURL == "" {
+		return client, nil
+	}
+	return client.WithEnterpriseURLs(Cfg.APIBaseURL(), strings.TrimSuffix(Cfg.GitHubURL, "/")+"/api/uploads/")
+}
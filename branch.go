@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"path/filepath"
+	"strings"
+)
+
+// branch creation and deletion
+//
+// git_multimail's ref change email for a new branch lists every commit it
+// can't find on another branch (which, in a clone that's missing some
+// history, can be most of the repo), and for a deleted branch is a single
+// line. The bot sends a short email of its own in place of either: where a new
+// branch starts and what it adds, or where a deleted branch was. The emails
+// for a new branch's commits still come from git_multimail. Either short email
+// can be turned off with [branches] in the config.
+
+// branchChange returns the name of the branch a push creates or deletes, if
+// it does.
+func branchChange(push pushInfo) (string, bool) {
+	name, ok := strings.CutPrefix(push.Ref, "refs/heads/")
+	if !ok || (push.Before != zeroSha && push.After != zeroSha) {
+		return "", false
+	}
+	return name, true
+}
+
+func (c CommitEmailConfig) branchEmailsEnabled(push pushInfo) bool {
+	enabled := c.Branches.Created
+	if push.After == zeroSha {
+		enabled = c.Branches.Deleted
+	}
+	return enabled == nil || *enabled
+}
+
+func commitSubject(gitDir string, rev string) string {
+	out, err := runGitCmd(gitDir, nil, "log", "-1", "--no-color", "--format=%s", rev)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// describeCommit is a short commit id followed by its subject, if the commit
+// is available.
+func describeCommit(gitDir string, rev string) string {
+	if subject := commitSubject(gitDir, rev); subject != "" {
+		return fmt.Sprintf("%.8s (%s)", rev, subject)
+	}
+	return fmt.Sprintf("%.8s", rev)
+}
+
+// newBranchBase finds the commits a new branch adds over the other branches,
+// and the branch it was most likely created from ("" if there is none).
+func newBranchBase(gitDir string, push pushInfo) (base string, commits []string, err error) {
+	// --exclude takes the branch name when it applies to --branches
+	others := []string{"--not", "--exclude=" + strings.TrimPrefix(push.Ref, "refs/heads/"), "--branches"}
+	commits, err = commitList(gitDir, append([]string{push.After}, others...)...)
+	if err != nil {
+		return "", nil, err
+	}
+	// the branch was created from the first commit that's already on another
+	// branch, following first parents back from the new commits
+	fork := push.After
+	if len(commits) > 0 {
+		out, err := runGitCmd(gitDir, nil, append([]string{"rev-list", "--first-parent", push.After}, others...)...)
+		if err != nil {
+			return "", nil, err
+		}
+		newCommits := strings.Fields(string(out))
+		if len(newCommits) == 0 {
+			return "", commits, nil
+		}
+		out, err = runGitCmd(gitDir, nil, "rev-parse", "--verify", "-q", newCommits[len(newCommits)-1]+"^")
+		if err != nil {
+			// the oldest new commit is a root commit
+			return "", commits, nil
+		}
+		fork = strings.TrimSpace(string(out))
+	}
+	out, err := runGitCmd(gitDir, nil, "for-each-ref", "--format=%(refname)", "--contains="+fork, "refs/heads/")
+	if err != nil {
+		return "", nil, err
+	}
+	// prefer the default branch when several contain the fork point
+	head, _ := runGitCmd(gitDir, nil, "symbolic-ref", "-q", "HEAD")
+	defaultBranch := strings.TrimSpace(string(head))
+	for _, ref := range strings.Fields(string(out)) {
+		if ref == push.Ref {
+			continue
+		}
+		if base == "" || ref == defaultBranch {
+			base = ref
+		}
+	}
+	return strings.TrimPrefix(base, "refs/heads/"), commits, nil
+}
+
+// isRefChangeEmail reports whether msg is git_multimail's ref change email,
+// as opposed to a commit's.
+func isRefChangeEmail(msg []byte) bool {
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		return false
+	}
+	return m.Header.Get("X-Git-NotificationType") == "ref_changed"
+}
+
+// repoShortName names a repo after its directory, as git_multimail does.
+func repoShortName(gitDir string) string {
+	dir := strings.TrimSuffix(filepath.Clean(gitDir), string(filepath.Separator)+".git")
+	return strings.TrimSuffix(filepath.Base(dir), ".git")
+}
+
+// branchMail formats the email for a push that creates or deletes a branch.
+// repo is the repo's short name, which prefixes the subject like
+// git_multimail's emails.
+func branchMail(gitDir string, to []string, repo string, push pushInfo) ([]byte, error) {
+	name, _ := branchChange(push)
+	var subject string
+	var body strings.Builder
+	if push.After == zeroSha {
+		subject = fmt.Sprintf("%s branch %s deleted", repo, name)
+		fmt.Fprintf(&body, "Branch %s was deleted. It was at %s.\n", name, describeCommit(gitDir, push.Before))
+	} else {
+		base, commits, err := newBranchBase(gitDir, push)
+		if err != nil {
+			return nil, fmt.Errorf("finding where %s was created from: %w", name, err)
+		}
+		subject = fmt.Sprintf("%s branch %s created", repo, name)
+		fmt.Fprintf(&body, "Branch %s was created at %s", name, describeCommit(gitDir, push.After))
+		if base != "" {
+			fmt.Fprintf(&body, "\nfrom %s", base)
+		}
+		switch len(commits) {
+		case 0:
+			body.WriteString(" with no new commits.\n")
+		case 1:
+			body.WriteString(" with 1 new commit:\n\n")
+		default:
+			fmt.Fprintf(&body, " with %d new commits:\n\n", len(commits))
+		}
+		for i, c := range commits {
+			if i == maxListedCommits {
+				fmt.Fprintf(&body, "  ... and %d more\n", len(commits)-i)
+				break
+			}
+			fmt.Fprintf(&body, "  %s\n", c)
+		}
+	}
+	return composeRepoMail(to, repo, subject, body.String()), nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBranchMail(t *testing.T) {
+	requireGit(t)
+	repo := newFixtureRepo(t)
+	repo.commit("Base")
+	fork := repo.commit("Fork point")
+	repo.git("checkout", "-q", "-b", "feature")
+	repo.commit("Feature one")
+	feature := repo.commit("Feature two")
+	repo.git("checkout", "-q", "main")
+	repo.commit("Later on main")
+	gitDir := repo.gitDir()
+	to := []string{"commits@example.com"}
+
+	msg, err := branchMail(gitDir, to, "proj", pushInfo{Before: zeroSha, After: feature, Ref: "refs/heads/feature"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Subject: proj branch feature created",
+		fmt.Sprintf("created at %.8s (Feature two)", feature),
+		"from main with 2 new commits:",
+		"Feature one",
+		"jD27HVpTX3tELRBjcpGsK6io7 proj",
+	} {
+		if !strings.Contains(string(msg), want) {
+			t.Errorf("created email is missing %q:\n%s", want, msg)
+		}
+	}
+
+	msg, err = branchMail(gitDir, to, "proj", pushInfo{Before: zeroSha, After: fork, Ref: "refs/heads/release"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(msg), "from main with no new commits.") {
+		t.Errorf("created email without new commits:\n%s", msg)
+	}
+
+	msg, err = branchMail(gitDir, to, "proj", pushInfo{Before: feature, After: zeroSha, Ref: "refs/heads/feature"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("It was at %.8s (Feature two).", feature); !strings.Contains(string(msg), want) {
+		t.Errorf("deleted email is missing %q:\n%s", want, msg)
+	}
+
+	config, err := parseConfig([]byte("to = \"commits@example.com\"\n[branches]\ndeleted = false\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.branchEmailsEnabled(pushInfo{Before: zeroSha, After: feature}) {
+		t.Error("created branch emails should default to enabled")
+	}
+	if config.branchEmailsEnabled(pushInfo{Before: feature, After: zeroSha}) {
+		t.Error("deleted branch emails were not disabled")
+	}
+}
+
+func TestIsRefChangeEmail(t *testing.T) {
+	refChange := "To: commits@example.com\nSubject: proj branch feature created\nX-Git-NotificationType: ref_changed\n\nbody\n"
+	revision := "To: commits@example.com\nSubject: proj feature: Feature one\nX-Git-NotificationType: diff\n\nbody\n"
+	if !isRefChangeEmail([]byte(refChange)) {
+		t.Error("ref change email not recognized")
+	}
+	if isRefChangeEmail([]byte(revision)) {
+		t.Error("commit email taken for a ref change email")
+	}
+}
+
+func TestDeletedBranchRemoved(t *testing.T) {
+	requireGit(t)
+	origin := newFixtureRepo(t)
+	origin.commit("Base")
+	origin.git("branch", "feature")
+	feature := origin.git("rev-parse", "feature")
+	gitDir := filepath.Join(t.TempDir(), "repo.git")
+	if err := gitClone(context.Background(), origin.dir, gitDir, nil, cloneFull); err != nil {
+		t.Fatal(err)
+	}
+
+	origin.git("branch", "-D", "feature")
+	opts := fetchOptions{mode: cloneFull, ref: "refs/heads/feature", before: feature}
+	if _, err := gitFetch(context.Background(), gitDir, nil, opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runGitCmd(gitDir, nil, "rev-parse", "--verify", "-q", "refs/heads/feature"); err == nil {
+		t.Error("deleted branch is still in the clone")
+	}
+	if !gitHasCommit(gitDir, feature) {
+		t.Error("deleted branch's commit is gone")
+	}
+}
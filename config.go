@@ -15,6 +15,29 @@ type CommitEmailConfig struct {
 	Email       struct {
 		Format string `toml:"format"`
 	}
+	Git struct {
+		// Clone overrides the deployment's clone mode for this repo
+		Clone string `toml:"clone"`
+	}
+	// Admin is emailed when the emails for a push can't be sent
+	Admin    string `toml:"admin"`
+	Failures struct {
+		// Issue and Status also report failures on GitHub, as an issue or as
+		// a status on the pushed commit
+		Issue  bool `toml:"issue"`
+		Status bool `toml:"status"`
+	}
+	Branches struct {
+		// Created and Deleted turn off the emails for new and deleted
+		// branches when set to false
+		Created *bool `toml:"created"`
+		Deleted *bool `toml:"deleted"`
+	}
+	GitHub struct {
+		// Report shows the result of every push on the pushed commit, as a
+		// commit status or a check run
+		Report string `toml:"report"`
+	} `toml:"github"`
 }
 
 type MissingConfigError struct{}
@@ -39,6 +62,17 @@ func parseConfig(configText []byte) (config CommitEmailConfig, err error) {
 	if !(format == "" || format == "html" || format == "text") {
 		return CommitEmailConfig{}, fmt.Errorf("invalid email.format (should be html or text): %s", format)
 	}
+	if clone := config.Git.Clone; !(clone == "" || validCloneMode(clone)) {
+		return CommitEmailConfig{}, fmt.Errorf("invalid git.clone (should be full, partial, or shallow): %s", clone)
+	}
+	if report := config.GitHub.Report; !(report == "" || report == reportStatus || report == reportCheck) {
+		return CommitEmailConfig{}, fmt.Errorf("invalid github.report (should be status or check): %s", report)
+	}
+	if config.Admin != "" {
+		if _, err := parseMailingList(config.Admin); err != nil {
+			return CommitEmailConfig{}, fmt.Errorf("invalid admin: %s", err)
+		}
+	}
 	return
 }
 
@@ -50,3 +84,23 @@ func getConfig(gitRepo string) (config CommitEmailConfig, err error) {
 	}
 	return parseConfig(configText)
 }
+
+// reportConfig reads the settings for reporting the result of a push, which
+// are needed even when the rest of the config is invalid. If the config at
+// HEAD can't be decoded at all, the one from before the push is used.
+func reportConfig(gitRepo string, before string) (CommitEmailConfig, bool) {
+	for _, rev := range []string{"HEAD", before} {
+		if rev == "" || rev == zeroSha {
+			continue
+		}
+		configText, err := GitShow(gitRepo, rev, ".github/commit-emails.toml")
+		if err != nil {
+			continue
+		}
+		var config CommitEmailConfig
+		if _, err := toml.Decode(string(configText), &config); err == nil {
+			return config, true
+		}
+	}
+	return CommitEmailConfig{}, false
+}
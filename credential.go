@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// We authenticate to GitHub using an installation access token, acting as the
+// bot itself (not the user). The documentation suggests to do this with the URL
+// https://x-access-token:<token>@github.com/owner/repo.git, but this would
+// store that URL in the git config in plaintext. The tokens are valid for 1
+// hour, which is still a lot of exposure.
+//
+// Instead git is configured (through GIT_CONFIG_* environment variables, so
+// nothing is written to disk) to use this binary as its credential helper,
+// and the token itself is passed in the environment of the git process. The
+// helper reads the token from its inherited environment and prints it to git
+// over a pipe. The token never appears in a command line (which any user on
+// the machine can see), in a config file, or in a shell snippet.
+
+const (
+	gitUserEnv  = "COMMIT_EMAILS_GIT_USERNAME"
+	gitTokenEnv = "COMMIT_EMAILS_GIT_TOKEN"
+	gitHostEnv  = "COMMIT_EMAILS_GIT_HOST"
+)
+
+// gitAuth is the credentials for fetching from a remote.
+type gitAuth struct {
+	username string
+	token    string
+	// host is the only host the helper gives the token to
+	host string
+}
+
+// newGitAuth authenticates to the host of cloneURL. GitHub installation tokens
+// use the username x-access-token.
+func newGitAuth(username string, token string, cloneURL string) *gitAuth {
+	host := ""
+	if u, err := url.Parse(cloneURL); err == nil {
+		host = u.Host
+	}
+	return &gitAuth{username: username, token: token, host: host}
+}
+
+// shellQuote quotes s for the shell git uses to run credential helpers.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// credentialHelperCommand is the credential.helper value that runs this binary.
+// git runs an absolute path directly when it has no special characters;
+// otherwise the path has to be quoted in a shell snippet.
+func credentialHelperCommand() string {
+	exe, err := os.Executable()
+	if err != nil {
+		exe = os.Args[0]
+	}
+	if filepath.IsAbs(exe) && !strings.ContainsAny(exe, " \t\n'\"\\$`|&;<>()*?[]#~=%") {
+		return exe + " credential-helper"
+	}
+	return "!" + shellQuote(exe) + " credential-helper"
+}
+
+// env returns the environment variables that give git access to the remote.
+// A nil auth is anonymous.
+func (a *gitAuth) env() []string {
+	if a == nil {
+		return nil
+	}
+	env := gitConfigEnv([]gitConfigParam{
+		// an empty helper clears any helpers from the user's config
+		{Key: "credential.helper", Value: ""},
+		{Key: "credential.helper", Value: credentialHelperCommand()},
+	})
+	return append(env,
+		gitUserEnv+"="+a.username,
+		gitTokenEnv+"="+a.token,
+		gitHostEnv+"="+a.host,
+	)
+}
+
+// credentialHelper implements the git credential helper protocol: git passes
+// the operation as an argument and key=value attributes on stdin, and for
+// "get" the helper prints the username and password.
+func credentialHelper(op string, in io.Reader, out io.Writer, getenv func(string) string) error {
+	attrs := make(map[string]string)
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		if key, val, ok := strings.Cut(line, "="); ok {
+			attrs[key] = val
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	// store and erase don't apply, since nothing is saved
+	if op != "get" {
+		return nil
+	}
+	token := getenv(gitTokenEnv)
+	if token == "" || attrs["protocol"] != "https" || attrs["host"] != getenv(gitHostEnv) {
+		return nil
+	}
+	_, err := fmt.Fprintf(out, "username=%s\npassword=%s\n", getenv(gitUserEnv), token)
+	return err
+}
+
+func credentialHelperMain(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: commit-email-bot credential-helper <get|store|erase>")
+		os.Exit(1)
+	}
+	if err := credentialHelper(args[0], os.Stdin, os.Stdout, os.Getenv); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const testToken = "ghs_TESTTOKEN'\"$(touch pwned)"
+
+func TestMain(m *testing.M) {
+	// git runs the test binary as its credential helper (see
+	// credentialHelperCommand)
+	if len(os.Args) > 1 && os.Args[1] == "credential-helper" {
+		credentialHelperMain(os.Args[2:])
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func requireGit(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+}
+
+func TestCredentialHelper(t *testing.T) {
+	env := map[string]string{
+		gitUserEnv:  "x-access-token",
+		gitTokenEnv: testToken,
+		gitHostEnv:  "github.com",
+	}
+	tests := []struct {
+		name  string
+		op    string
+		input string
+		want  string
+	}{
+		{"get", "get", "protocol=https\nhost=github.com\n\n",
+			"username=x-access-token\npassword=" + testToken + "\n"},
+		{"other host", "get", "protocol=https\nhost=example.com\n\n", ""},
+		{"http", "get", "protocol=http\nhost=github.com\n\n", ""},
+		{"store", "store", "protocol=https\nhost=github.com\nusername=u\npassword=p\n\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			err := credentialHelper(tt.op, strings.NewReader(tt.input), out,
+				func(key string) string { return env[key] })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("got %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+// TestGitCredentialFill checks that git actually gets the token from the
+// helper.
+func TestGitCredentialFill(t *testing.T) {
+	requireGit(t)
+	auth := newGitAuth("x-access-token", testToken, "https://github.com/owner/repo.git")
+	cmd := exec.Command("git", "credential", "fill")
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.Env = append(cmd.Env, auth.env()...)
+	cmd.Stdin = strings.NewReader("protocol=https\nhost=github.com\npath=owner/repo.git\n\n")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git credential fill: %v: %s", err, out)
+	}
+	if !strings.Contains(string(out), "password="+testToken+"\n") {
+		t.Errorf("token not returned by helper, got:\n%s", out)
+	}
+}
+
+// TestTokenNotExposed clones and fetches from an HTTPS remote that requires
+// the token, and checks that git got it from the credential helper and that
+// it doesn't show up in any git command line, in the repo's config, or in the
+// logs.
+func TestTokenNotExposed(t *testing.T) {
+	requireGit(t)
+	tmp := t.TempDir()
+
+	// a wrapper around git that records its arguments
+	realGit, _ := exec.LookPath("git")
+	binDir := filepath.Join(tmp, "bin")
+	argvLog := filepath.Join(tmp, "argv.log")
+	if err := os.Mkdir(binDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	wrapper := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %s\nexec %s \"$@\"\n",
+		shellQuote(argvLog), shellQuote(realGit))
+	if err := os.WriteFile(filepath.Join(binDir, "git"), []byte(wrapper), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("GIT_TERMINAL_PROMPT", "0")
+
+	logs := &bytes.Buffer{}
+	oldLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(oldLogger) })
+
+	fixtures := filepath.Join(tmp, "fixtures")
+	origin := filepath.Join(fixtures, "owner", "repo")
+	for _, args := range [][]string{
+		{"init", "--quiet", "-b", "main", origin},
+		{"-C", origin, "-c", "user.name=Test", "-c", "user.email=test@example.com",
+			"commit", "--quiet", "--allow-empty", "-m", "initial"},
+	} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+
+	// fake-github's git server, behind HTTPS and basic auth with the token
+	fake := &fakeGitHub{repos: fixtures}
+	var authorized atomic.Int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user, pass, ok := req.BasicAuth()
+		if !ok || user != "x-access-token" || pass != testToken {
+			w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		authorized.Add(1)
+		fake.handler().ServeHTTP(w, req)
+	}))
+	defer server.Close()
+	caFile := filepath.Join(tmp, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GIT_SSL_CAINFO", caFile)
+
+	cloneURL := server.URL + "/owner/repo.git"
+	gitDir := filepath.Join(tmp, "repos", "repo")
+	if err := gitClone(context.Background(), cloneURL, filepath.Join(tmp, "anonymous"), nil, cloneFull); err == nil {
+		t.Fatal("clone without the token succeeded")
+	}
+	auth := newGitAuth("x-access-token", testToken, cloneURL)
+	if err := gitClone(context.Background(), cloneURL, gitDir, auth, cloneFull); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := gitFetch(context.Background(), gitDir, auth, fetchOptions{mode: cloneFull, ref: "refs/heads/main"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog.Info("fetch", stats.attrs()...)
+	if authorized.Load() == 0 {
+		t.Fatal("the server never got the token")
+	}
+	if !gitHasCommit(gitDir, "refs/heads/main") {
+		t.Error("clone is missing main")
+	}
+
+	argv, err := os.ReadFile(argvLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(argv) == 0 {
+		t.Fatal("git wrapper was not used")
+	}
+	config, err := os.ReadFile(filepath.Join(gitDir, "config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string][]byte{
+		"argv":   argv,
+		"config": config,
+		"logs":   logs.Bytes(),
+	} {
+		if bytes.Contains(contents, []byte("TESTTOKEN")) {
+			t.Errorf("token found in %s:\n%s", name, contents)
+		}
+	}
+	for _, kv := range auth.env() {
+		if strings.HasPrefix(kv, "GIT_CONFIG_VALUE_") && strings.Contains(kv, "TESTTOKEN") {
+			t.Errorf("token in git config parameter %s", kv)
+		}
+	}
+	if _, err := os.Stat("pwned"); err == nil {
+		t.Error("token was interpreted by a shell")
+	}
+}
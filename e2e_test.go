@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// End-to-end tests: each recorded delivery in test-pushes/ is replayed against
+// a fixture repo with the same commits (same messages, authors, and dates, but
+// synthetic contents), through githubEventHandler with the fake GitHub from
+// fakegithub.go serving the API and the clone. The emails git_multimail
+// generates are compared to testdata/e2e/<name>.golden.
+//
+// Run with -update to regenerate the golden files. They have to be generated
+// where git_multimail is installed; until they are committed, the test fails
+// for each missing one.
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/e2e")
+
+const (
+	e2eRecipient = "commits@example.com"
+	e2eSecret    = "e2e-webhook-secret"
+)
+
+func requireMultimail(t *testing.T) {
+	t.Helper()
+	requireGit(t)
+	if err := exec.Command("python3", "-c", "import git_multimail").Run(); err != nil {
+		t.Skip("git_multimail not installed")
+	}
+}
+
+func testAppKey(t *testing.T) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+}
+
+// fixtureGit runs git in dir, isolated from the user's config.
+func fixtureGit(t *testing.T, dir string, env []string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_CONFIG_GLOBAL=/dev/null",
+		"GIT_CONFIG_NOSYSTEM=1",
+	)
+	cmd.Env = append(cmd.Env, env...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// fixtureRepo is a work tree for unit tests, with main checked out and
+// commits by a fixed author.
+type fixtureRepo struct {
+	t   *testing.T
+	dir string
+	// n makes every commit's contents different, so a commit with the same
+	// message as an earlier one is still a new commit
+	n int
+}
+
+func newFixtureRepo(t *testing.T) *fixtureRepo {
+	t.Helper()
+	r := &fixtureRepo{t: t, dir: t.TempDir()}
+	r.git("init", "-q", "-b", "main")
+	return r
+}
+
+func (r *fixtureRepo) gitDir() string {
+	return filepath.Join(r.dir, ".git")
+}
+
+// git runs git in the work tree and returns its output.
+func (r *fixtureRepo) git(args ...string) string {
+	r.t.Helper()
+	return fixtureGit(r.t, r.dir, []string{
+		"GIT_AUTHOR_NAME=Test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=Test", "GIT_COMMITTER_EMAIL=test@example.com",
+	}, args...)
+}
+
+// commit changes a file, commits everything in the work tree, and returns
+// the commit's id.
+func (r *fixtureRepo) commit(msg string) string {
+	r.t.Helper()
+	r.n++
+	if err := os.WriteFile(filepath.Join(r.dir, "file"), []byte(fmt.Sprintf("%s %d\n", msg, r.n)), 0644); err != nil {
+		r.t.Fatal(err)
+	}
+	r.git("add", "-A")
+	r.git("commit", "-q", "-m", msg)
+	return r.git("rev-parse", "HEAD")
+}
+
+type fixtureCommit struct {
+	ID        string   `json:"id"`
+	Message   string   `json:"message"`
+	Timestamp string   `json:"timestamp"`
+	Added     []string `json:"added"`
+	Modified  []string `json:"modified"`
+	Removed   []string `json:"removed"`
+	Author    struct {
+		Name  string `json:"name"`
+		Email string `json:"email"`
+	} `json:"author"`
+	Committer struct {
+		Name  string `json:"name"`
+		Email string `json:"email"`
+	} `json:"committer"`
+}
+
+// buildFixture creates a repo in dir with a base commit holding config on the
+// default branch and the pushed commits on top of it, then rewrites the
+// payload to refer to the fixture's commits and cloneURL.
+func buildFixture(t *testing.T, dir string, cloneURL string, config string, payload []byte) []byte {
+	var ev map[string]any
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		t.Fatal(err)
+	}
+	var commits []fixtureCommit
+	data, _ := json.Marshal(ev["commits"])
+	if err := json.Unmarshal(data, &commits); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	fixtureGit(t, dir, nil, "init", "-q", "-b", "main")
+	if err := os.MkdirAll(filepath.Join(dir, ".github"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".github", "commit-emails.toml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	baseEnv := []string{
+		"GIT_AUTHOR_NAME=Fixture", "GIT_AUTHOR_EMAIL=fixture@example.com",
+		"GIT_COMMITTER_NAME=Fixture", "GIT_COMMITTER_EMAIL=fixture@example.com",
+		"GIT_AUTHOR_DATE=2024-01-01T00:00:00Z", "GIT_COMMITTER_DATE=2024-01-01T00:00:00Z",
+	}
+	fixtureGit(t, dir, baseEnv, "add", "-A")
+	fixtureGit(t, dir, baseEnv, "commit", "-q", "-m", "Initial commit")
+	base := fixtureGit(t, dir, nil, "rev-parse", "HEAD")
+
+	ids := map[string]string{ev["before"].(string): base}
+	fixtureGit(t, dir, nil, "checkout", "-q", "--detach")
+	for _, c := range commits {
+		for _, path := range append(c.Added, c.Modified...) {
+			name := filepath.Join(dir, path)
+			if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fmt.Fprintf(f, "%s\n", strings.SplitN(c.Message, "\n", 2)[0])
+			f.Close()
+		}
+		for _, path := range c.Removed {
+			_ = os.Remove(filepath.Join(dir, path))
+		}
+		env := []string{
+			"GIT_AUTHOR_NAME=" + c.Author.Name, "GIT_AUTHOR_EMAIL=" + c.Author.Email,
+			"GIT_COMMITTER_NAME=" + c.Committer.Name, "GIT_COMMITTER_EMAIL=" + c.Committer.Email,
+			"GIT_AUTHOR_DATE=" + c.Timestamp, "GIT_COMMITTER_DATE=" + c.Timestamp,
+		}
+		fixtureGit(t, dir, env, "add", "-A")
+		fixtureGit(t, dir, env, "commit", "-q", "--allow-empty", "-m", c.Message)
+		ids[c.ID] = fixtureGit(t, dir, nil, "rev-parse", "HEAD")
+	}
+	after, ok := ids[ev["after"].(string)]
+	if !ok {
+		t.Fatalf("after commit %s is not in the payload", ev["after"])
+	}
+	fixtureGit(t, dir, nil, "update-ref", ev["ref"].(string), after)
+	fixtureGit(t, dir, nil, "checkout", "-q", "main")
+
+	ev["before"] = base
+	ev["after"] = after
+	for _, c := range ev["commits"].([]any) {
+		c := c.(map[string]any)
+		c["id"] = ids[c["id"].(string)]
+	}
+	if head, ok := ev["head_commit"].(map[string]any); ok {
+		head["id"] = ids[head["id"].(string)]
+	}
+	ev["repository"].(map[string]any)["clone_url"] = cloneURL
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+// volatileHeaders vary between runs.
+var volatileHeaders = regexp.MustCompile(`(?m)^(Date|Message-ID|In-Reply-To|References|Thread-Index|X-Git-Host|X-Git-Multimail-Version): .*$`)
+
+func normalizeEmails(out []byte) []byte {
+	var golden bytes.Buffer
+	for _, msg := range splitMultimailOutput(out) {
+		golden.WriteString(multimailSeparator + "\n")
+		golden.Write(volatileHeaders.ReplaceAll(msg, []byte("$1: <normalized>")))
+	}
+	return golden.Bytes()
+}
+
+// setupE2E configures a server that talks to a fake GitHub serving the repos
+// in fixtures, and writes emails to the returned buffer.
+func setupE2E(t *testing.T, fixtures string) (Server, *bytes.Buffer, *fakeGitHub) {
+	persist := t.TempDir()
+	fake := &fakeGitHub{repos: fixtures}
+	gh := httptest.NewServer(fake.handler())
+	t.Cleanup(gh.Close)
+	fake.url = gh.URL
+
+	savedCfg, savedStdout := Cfg, mailStdout
+	t.Cleanup(func() {
+		Cfg, mailStdout = savedCfg, savedStdout
+	})
+	mail := &bytes.Buffer{}
+	mailStdout = mail
+
+	Cfg.PersistPath = persist
+	Cfg.Hostname = "localhost"
+	Cfg.Port = "8080"
+	Cfg.GitHubURL = gh.URL
+	Cfg.WebhookSecret = []byte(e2eSecret)
+	Cfg.SmtpPassword = ""
+	Cfg.AppId = 1
+	Cfg.AppPrivateKey = testAppKey(t)
+	Cfg.CloneMode = cloneFull
+	Cfg.Access = openAccessPolicy(persist, false)
+
+	srv, err := newServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, mail, fake
+}
+
+func TestEndToEnd(t *testing.T) {
+	requireMultimail(t)
+	files, err := filepath.Glob("test-pushes/*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no test pushes found")
+	}
+	config := fmt.Sprintf("to = %q\n", e2eRecipient)
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".yaml")
+		t.Run(name, func(t *testing.T) {
+			d, err := readDeliveryFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ev struct {
+				Repository struct {
+					FullName string `json:"full_name"`
+				} `json:"repository"`
+			}
+			if err := json.Unmarshal([]byte(d.Payload), &ev); err != nil {
+				t.Fatal(err)
+			}
+			fixtures := t.TempDir()
+			srv, mail, fake := setupE2E(t, fixtures)
+			payload := buildFixture(t,
+				filepath.Join(fixtures, ev.Repository.FullName),
+				fake.url+"/"+ev.Repository.FullName+".git",
+				config, []byte(d.Payload))
+			token := newVerifyToken()
+			if err := srv.db.AddRecipient(ev.Repository.FullName, e2eRecipient, token); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := srv.db.VerifyRecipient(token); err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest("POST", "/webhook", bytes.NewReader(payload))
+			for key, val := range d.Headers {
+				if key == "Request method" || strings.HasPrefix(key, "X-Hub-Signature") {
+					continue
+				}
+				req.Header.Set(key, val.Value)
+			}
+			mac := hmac.New(sha256.New, []byte(e2eSecret))
+			mac.Write(payload)
+			req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+			rec := httptest.NewRecorder()
+			srv.githubEventHandler(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("webhook returned %d: %s", rec.Code, rec.Body.String())
+			}
+
+			got := normalizeEmails(mail.Bytes())
+			if len(got) == 0 {
+				t.Fatal("no emails were generated")
+			}
+			goldenFile := filepath.Join("testdata", "e2e", name+".golden")
+			if *update {
+				if err := os.MkdirAll(filepath.Dir(goldenFile), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(goldenFile, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(goldenFile)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create it)", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("emails differ from %s (run with -update to accept)\n%s", goldenFile, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// failed pushes
+//
+// A push that fails is saved to persist/failed with its error, so it can be
+// re-run once the problem is fixed instead of redelivering it from GitHub. The
+// failed subcommand and the /admin/failed endpoints list and retry them.
+//
+// A failure is forgotten once a later push to the same repo succeeds, and
+// failures are kept for at most maxFailedAge, up to maxFailedJobs of them.
+// Like a resumed push, a retry skips the emails that were already sent.
+
+const (
+	maxFailedJobs = 1000
+	maxFailedAge  = 30 * 24 * time.Hour
+)
+
+type failedJob struct {
+	Job      pushJob   `json:"job"`
+	Error    string    `json:"error"`
+	Failed   time.Time `json:"failed"`
+	Attempts int       `json:"attempts"`
+}
+
+type failedJobs struct {
+	dir string
+	// limits on the saved failures, maxFailedJobs and maxFailedAge
+	maxJobs int
+	maxAge  time.Duration
+
+	mu sync.Mutex
+}
+
+func newFailedJobs(persistPath string) (*failedJobs, error) {
+	dir := filepath.Join(persistPath, "failed")
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return nil, err
+	}
+	return &failedJobs{dir: dir, maxJobs: maxFailedJobs, maxAge: maxFailedAge}, nil
+}
+
+func (f *failedJobs) path(delivery string) string {
+	return filepath.Join(f.dir, delivery+".json")
+}
+
+func (f *failedJobs) read(delivery string) (failedJob, error) {
+	var job failedJob
+	data, err := os.ReadFile(f.path(delivery))
+	if err != nil {
+		return job, err
+	}
+	err = json.Unmarshal(data, &job)
+	return job, err
+}
+
+// add saves a failed job, counting the attempts if it failed before.
+func (f *failedJobs) add(job pushJob, jobErr error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	attempts := 1
+	if prev, err := f.read(job.Delivery); err == nil {
+		attempts = prev.Attempts + 1
+	}
+	data, err := json.Marshal(failedJob{
+		Job:      job,
+		Error:    jobErr.Error(),
+		Failed:   time.Now(),
+		Attempts: attempts,
+	})
+	if err != nil {
+		return err
+	}
+	tmp := f.path(job.Delivery) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0660); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, f.path(job.Delivery)); err != nil {
+		return err
+	}
+	return f.prune(time.Now())
+}
+
+// prune removes failures older than f.maxAge, and then the oldest ones
+// beyond f.maxJobs. f.mu must be held.
+func (f *failedJobs) prune(now time.Time) error {
+	jobs, err := f.readAll()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	kept := 0
+	// newest first, so the oldest are the ones over the limit
+	for i := len(jobs) - 1; i >= 0; i-- {
+		job := jobs[i]
+		if now.Sub(job.Failed) <= f.maxAge && kept < f.maxJobs {
+			kept++
+			continue
+		}
+		if err := f.removeLocked(job.Job.Delivery); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (f *failedJobs) removeLocked(delivery string) error {
+	err := os.Remove(f.path(delivery))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (f *failedJobs) remove(delivery string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.removeLocked(delivery)
+}
+
+// clearRepo removes the failures of pushes to repo that were received
+// before a push that succeeded. It returns how many were removed.
+func (f *failedJobs) clearRepo(repo string, before time.Time) (int, error) {
+	if repo == "" {
+		return 0, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	jobs, err := f.readAll()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, job := range jobs {
+		if !job.Job.Received.Before(before) || job.Job.repo() != repo {
+			continue
+		}
+		if err := f.removeLocked(job.Job.Delivery); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// get looks up a failed job by its delivery id.
+func (f *failedJobs) get(delivery string) (failedJob, error) {
+	if jobID(delivery) != delivery {
+		return failedJob{}, fmt.Errorf("invalid delivery %q", delivery)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	job, err := f.read(delivery)
+	if errors.Is(err, os.ErrNotExist) {
+		return job, fmt.Errorf("no failed push %s", delivery)
+	}
+	return job, err
+}
+
+// list returns the failed jobs, oldest first.
+func (f *failedJobs) list() ([]failedJob, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.readAll()
+}
+
+// readAll reads the failed jobs, oldest first. f.mu must be held.
+func (f *failedJobs) readAll() ([]failedJob, error) {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []failedJob
+	for _, e := range entries {
+		delivery, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		job, err := f.read(delivery)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", e.Name(), err)
+		}
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Job.Received.Before(jobs[j].Job.Received)
+	})
+	return jobs, nil
+}
+
+// recordResult saves a push that failed so it can be retried. When a push
+// succeeds, its own earlier failure (eg, when GitHub redelivers it) and
+// those of older pushes to the same repo are forgotten. A push interrupted by
+// shutdown isn't a failure, since it will be resumed.
+func (srv Server) recordResult(job pushJob, jobErr error, logger *slog.Logger) {
+	if jobErr != nil && srv.jobs.interrupted() {
+		return
+	}
+	if jobErr != nil {
+		if err := srv.failed.add(job, jobErr); err != nil {
+			logger.Error("saving failed push", slog.String("error", err.Error()))
+		}
+		return
+	}
+	if err := srv.failed.remove(job.Delivery); err != nil {
+		logger.Error("removing failed push", slog.String("error", err.Error()))
+	}
+	cleared, err := srv.failed.clearRepo(job.repo(), job.Received)
+	if err != nil {
+		logger.Error("clearing older failed pushes", slog.String("error", err.Error()))
+	}
+	if cleared > 0 {
+		logger.Info("cleared older failed pushes", slog.Int("count", cleared))
+	}
+}
+
+// retryFailed re-runs a failed push, removing it if it succeeds.
+func (srv Server) retryFailed(delivery string) error {
+	failed, err := srv.failed.get(delivery)
+	if err != nil {
+		return err
+	}
+	job := failed.Job
+	logger := slog.With(slog.String("delivery", job.Delivery))
+	done, err := srv.jobs.start(job)
+	if err != nil {
+		return err
+	}
+	logger.Info("retrying failed push",
+		slog.Int("attempts", failed.Attempts),
+		slog.Int("already sent", job.Sent))
+	err = srv.runJob(&job, logger)
+	srv.recordResult(job, err, logger)
+	done(err)
+	return err
+}
+
+type retryResult struct {
+	Delivery string `json:"delivery"`
+	Error    string `json:"error,omitempty"`
+}
+
+// retryAllFailed re-runs every failed push, one at a time.
+func (srv Server) retryAllFailed() ([]retryResult, error) {
+	jobs, err := srv.failed.list()
+	if err != nil {
+		return nil, err
+	}
+	var results []retryResult
+	for _, failed := range jobs {
+		result := retryResult{Delivery: failed.Job.Delivery}
+		if err := srv.retryFailed(failed.Job.Delivery); err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// adminAuthorized checks for the admin token as a bearer token. The admin
+// endpoints are disabled if no token is configured.
+func adminAuthorized(w http.ResponseWriter, req *http.Request) bool {
+	if Cfg.AdminToken == "" {
+		http.NotFound(w, req)
+		return false
+	}
+	token, _ := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(Cfg.AdminToken)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// failedHandler lists failed pushes (GET) or retries them (POST, with id set
+// to a delivery or "all").
+func (srv Server) failedHandler(w http.ResponseWriter, req *http.Request) {
+	if !adminAuthorized(w, req) {
+		return
+	}
+	var result any
+	switch req.Method {
+	case http.MethodGet:
+		jobs, err := srv.failed.list()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result = jobs
+	case http.MethodPost:
+		id := req.FormValue("id")
+		if id == "" {
+			http.Error(w, "id is required (a delivery or all)", http.StatusBadRequest)
+			return
+		}
+		if id == "all" {
+			results, err := srv.retryAllFailed()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			result = results
+		} else {
+			r := retryResult{Delivery: id}
+			if err := srv.retryFailed(id); err != nil {
+				r.Error = err.Error()
+			}
+			result = []retryResult{r}
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+func failedMain(args []string) {
+	fs := flag.NewFlagSet("failed", flag.ExitOnError)
+	fs.StringVar(&Cfg.PersistPath, "persist", Cfg.PersistPath, "directory for persistent data")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: commit-email-bot failed [-persist dir] list")
+		fmt.Fprintln(fs.Output(), "       commit-email-bot failed [-persist dir] retry <delivery>... | all")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: Cfg.LogLevel})))
+	srv, err := newServer()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch fs.Arg(0) {
+	case "list":
+		jobs, err := srv.failed.list()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, job := range jobs {
+			source := job.Job.Source
+			if source == sourceGitHub {
+				source = "github"
+			}
+			fmt.Printf("%s\t%s\t%s\tattempts=%d\t%s\n",
+				job.Job.Delivery, source, job.Failed.Format(time.RFC3339), job.Attempts, job.Error)
+		}
+	case "retry":
+		deliveries := fs.Args()[1:]
+		if len(deliveries) == 0 {
+			log.Fatal("retry needs a delivery id or all")
+		}
+		failed := 0
+		if len(deliveries) == 1 && deliveries[0] == "all" {
+			results, err := srv.retryAllFailed()
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, r := range results {
+				if r.Error != "" {
+					failed++
+				}
+			}
+			fmt.Printf("retried %d pushes, %d failed\n", len(results), failed)
+		} else {
+			for _, delivery := range deliveries {
+				if err := srv.retryFailed(delivery); err != nil {
+					fmt.Fprintf(os.Stderr, "%s: %v\n", delivery, err)
+					failed++
+				}
+			}
+		}
+		if failed > 0 {
+			os.Exit(1)
+		}
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
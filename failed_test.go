@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func testPushJob(delivery string, repo string, received time.Time) pushJob {
+	payload, _ := json.Marshal(map[string]any{
+		"ref":        "refs/heads/main",
+		"repository": map[string]any{"full_name": repo},
+	})
+	return pushJob{Delivery: delivery, Event: "push", Payload: payload, Received: received}
+}
+
+func failedDeliveries(t *testing.T, f *failedJobs) []string {
+	t.Helper()
+	jobs, err := f.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deliveries []string
+	for _, job := range jobs {
+		deliveries = append(deliveries, job.Job.Delivery)
+	}
+	return deliveries
+}
+
+func TestFailedClearedBySuccess(t *testing.T) {
+	jobs, err := newJobTracker(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed, err := newFailedJobs(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := Server{jobs: jobs, failed: failed}
+	start := time.Now()
+	pushErr := errors.New("bad config")
+	for i, job := range []pushJob{
+		testPushJob("old", "alice/proj", start),
+		testPushJob("other", "bob/proj", start.Add(time.Second)),
+		testPushJob("new", "alice/proj", start.Add(3*time.Second)),
+	} {
+		job.Sent = i
+		srv.recordResult(job, pushErr, slog.Default())
+	}
+	prev, err := failed.get("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prev.Job.Sent != 2 {
+		t.Errorf("failed push kept %d sent emails, want 2", prev.Job.Sent)
+	}
+
+	srv.recordResult(testPushJob("fixed", "alice/proj", start.Add(2*time.Second)), nil, slog.Default())
+	got := failedDeliveries(t, failed)
+	if fmt.Sprint(got) != "[other new]" {
+		t.Errorf("failed pushes after a success are %v, want [other new]", got)
+	}
+}
+
+func TestFailedPruned(t *testing.T) {
+	failed, err := newFailedJobs(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed.maxJobs = 5
+	start := time.Now()
+	for i := range failed.maxJobs + 2 {
+		job := testPushJob(fmt.Sprintf("push-%d", i), "alice/proj", start.Add(time.Duration(i)*time.Second))
+		if err := failed.add(job, errors.New("failed")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := failedDeliveries(t, failed)
+	if len(got) != failed.maxJobs || got[0] != "push-2" {
+		t.Errorf("kept failed pushes %v, want %d starting at push-2", got, failed.maxJobs)
+	}
+
+	failed.mu.Lock()
+	err = failed.prune(time.Now().Add(maxFailedAge + time.Hour))
+	failed.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := failedDeliveries(t, failed); len(got) != 0 {
+		t.Errorf("%d failed pushes left after they expired", len(got))
+	}
+}
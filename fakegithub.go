@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/cgi"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v62/github"
+)
+
+// fake GitHub, for running the bot offline
+//
+// The fake-github subcommand serves the few endpoints the bot uses from a
+// directory of local repos laid out as <owner>/<repo> (work trees or bare
+// repos, optionally with a .git suffix):
+//
+//   - installation token creation, which ghinstallation calls
+//   - repository contents, for .github/commit-emails.toml
+//   - commit statuses, check runs, and issues, which are only logged
+//   - git's smart HTTP protocol, through git http-backend
+//
+// Point the bot at it with GITHUB_URL. Since recorded deliveries refer to
+// github.com, the fake also builds push events for its own repos and sends
+// them to the bot.
+
+const fakeInstallation = 1
+
+type fakeGitHub struct {
+	// repos is the directory of fixture repos
+	repos string
+	// url is the address the fake is reachable at, for clone URLs
+	url string
+	// webhook and secret are where to send push events and how to sign them
+	webhook string
+	secret  []byte
+}
+
+func (f *fakeGitHub) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v3/app/installations/{id}/access_tokens", f.accessToken)
+	mux.HandleFunc("GET /api/v3/repos/{owner}/{repo}/contents/{path...}", f.contents)
+	mux.HandleFunc("POST /api/v3/repos/{owner}/{repo}/statuses/{sha}", f.logged("status"))
+	mux.HandleFunc("POST /api/v3/repos/{owner}/{repo}/issues", f.logged("issue"))
+	mux.HandleFunc("POST /api/v3/repos/{owner}/{repo}/check-runs", f.logged("check run"))
+	mux.HandleFunc("GET /{owner}/{repo}/info/refs", f.gitHTTP)
+	mux.HandleFunc("POST /{owner}/{repo}/git-upload-pack", f.gitHTTP)
+	mux.HandleFunc("POST /_fake/push/{owner}/{repo}", f.push)
+	return mux
+}
+
+func fakeNotFound(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	_, _ = w.Write([]byte(`{"message":"Not Found"}`))
+}
+
+// gitDir finds the fixture repo for owner/repo.
+func (f *fakeGitHub) gitDir(owner, repo string) (string, error) {
+	repo = strings.TrimSuffix(repo, ".git")
+	if err := validRepoName(owner + "/" + repo); err != nil {
+		return "", err
+	}
+	for _, name := range []string{repo, repo + ".git"} {
+		path := filepath.Join(f.repos, owner, name)
+		if _, err := os.Stat(path); err == nil {
+			return localGitDir(path)
+		}
+	}
+	return "", fmt.Errorf("no repo %s/%s", owner, repo)
+}
+
+func (f *fakeGitHub) accessToken(w http.ResponseWriter, req *http.Request) {
+	token := make([]byte, 16)
+	_, _ = rand.Read(token)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(github.InstallationToken{
+		Token:     github.String("ghs_" + hex.EncodeToString(token)),
+		ExpiresAt: &github.Timestamp{Time: time.Now().Add(time.Hour)},
+	})
+}
+
+func (f *fakeGitHub) contents(w http.ResponseWriter, req *http.Request) {
+	gitDir, err := f.gitDir(req.PathValue("owner"), req.PathValue("repo"))
+	if err != nil {
+		fakeNotFound(w)
+		return
+	}
+	ref := req.URL.Query().Get("ref")
+	if ref == "" {
+		ref = "HEAD"
+	}
+	path := req.PathValue("path")
+	content, err := GitShow(gitDir, ref, path)
+	if err != nil {
+		fakeNotFound(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(github.RepositoryContent{
+		Type:     github.String("file"),
+		Name:     github.String(filepath.Base(path)),
+		Path:     github.String(path),
+		Encoding: github.String("base64"),
+		Content:  github.String(base64.StdEncoding.EncodeToString(content)),
+	})
+}
+
+// logged accepts a request that creates something on GitHub (like a commit
+// status) by logging it.
+func (f *fakeGitHub) logged(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		log.Printf("%s for %s/%s: %s", kind, req.PathValue("owner"), req.PathValue("repo"), body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"number":1}`))
+	}
+}
+
+// gitHTTP serves fetches and clones with git http-backend.
+func (f *fakeGitHub) gitHTTP(w http.ResponseWriter, req *http.Request) {
+	owner, repo := req.PathValue("owner"), req.PathValue("repo")
+	gitDir, err := f.gitDir(owner, repo)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	env := []string{
+		// the repo is the whole project root, so PATH_INFO is just the
+		// service (eg, /info/refs)
+		"GIT_PROJECT_ROOT=" + gitDir,
+		"GIT_HTTP_EXPORT_ALL=1",
+	}
+	// partial and shallow clones fetch specific commits and filter blobs
+	env = append(env, gitConfigEnv([]gitConfigParam{
+		{Key: "uploadpack.allowFilter", Value: "true"},
+		{Key: "uploadpack.allowAnySHA1InWant", Value: "true"},
+	})...)
+	h := &cgi.Handler{
+		Path: gitPath,
+		Args: []string{"http-backend"},
+		Root: "/" + owner + "/" + repo,
+		Env:  env,
+	}
+	h.ServeHTTP(w, req)
+}
+
+// pushEvent builds a GitHub push event for a ref update in a fixture repo.
+func (f *fakeGitHub) pushEvent(owner, repo, ref, before, after string) (*github.PushEvent, error) {
+	repo = strings.TrimSuffix(repo, ".git")
+	gitDir, err := f.gitDir(owner, repo)
+	if err != nil {
+		return nil, err
+	}
+	fullName := owner + "/" + repo
+	htmlURL := f.url + "/" + fullName
+	ev := &github.PushEvent{
+		Ref:     github.String(ref),
+		Before:  github.String(before),
+		After:   github.String(after),
+		Created: github.Bool(before == zeroSha),
+		Deleted: github.Bool(after == zeroSha),
+		Forced:  github.Bool(false),
+		Repo: &github.PushEventRepository{
+			ID:       github.Int64(1),
+			Name:     github.String(repo),
+			FullName: github.String(fullName),
+			Owner:    &github.User{Login: github.String(owner), Name: github.String(owner)},
+			Private:  github.Bool(false),
+			HTMLURL:  github.String(htmlURL),
+			CloneURL: github.String(htmlURL + ".git"),
+		},
+		Pusher:       &github.CommitAuthor{Name: github.String("fake-github")},
+		Installation: &github.Installation{ID: github.Int64(fakeInstallation)},
+	}
+	if after == zeroSha {
+		return ev, nil
+	}
+	revs := after
+	if before != zeroSha {
+		revs = before + ".." + after
+	}
+	out, err := runGitCmd(gitDir, nil, "log", "--reverse", "-n", "20",
+		"--format=%H%x00%an%x00%ae%x00%cn%x00%ce%x00%cI%x00%B%x1e", revs)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range strings.Split(string(out), "\x1e") {
+		fields := strings.Split(strings.TrimPrefix(record, "\n"), "\x00")
+		if len(fields) != 7 {
+			continue
+		}
+		timestamp, _ := time.Parse(time.RFC3339, fields[5])
+		ev.Commits = append(ev.Commits, &github.HeadCommit{
+			ID:        github.String(fields[0]),
+			Message:   github.String(strings.TrimSpace(fields[6])),
+			Timestamp: &github.Timestamp{Time: timestamp},
+			URL:       github.String(htmlURL + "/commit/" + fields[0]),
+			Author:    &github.CommitAuthor{Name: github.String(fields[1]), Email: github.String(fields[2])},
+			Committer: &github.CommitAuthor{Name: github.String(fields[3]), Email: github.String(fields[4])},
+		})
+	}
+	if len(ev.Commits) > 0 {
+		ev.HeadCommit = ev.Commits[len(ev.Commits)-1]
+	}
+	return ev, nil
+}
+
+// push sends the bot a push event for a fixture repo, taking the ref,
+// before, and after from the form. The ref defaults to the repo's HEAD,
+// after to the ref, and before to the commit before it.
+func (f *fakeGitHub) push(w http.ResponseWriter, req *http.Request) {
+	owner, repo := req.PathValue("owner"), req.PathValue("repo")
+	gitDir, err := f.gitDir(owner, repo)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	resolve := func(rev string) (string, error) {
+		if strings.Trim(rev, "0") == "" {
+			return zeroSha, nil
+		}
+		return resolveCommit(gitDir, rev)
+	}
+	ref := req.FormValue("ref")
+	if ref == "" {
+		out, err := runGitCmd(gitDir, nil, "symbolic-ref", "HEAD")
+		if err != nil {
+			http.Error(w, "ref is required", http.StatusBadRequest)
+			return
+		}
+		ref = strings.TrimSpace(string(out))
+	}
+	afterRev := req.FormValue("after")
+	if afterRev == "" {
+		afterRev = ref
+	}
+	after, err := resolve(afterRev)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	beforeRev := req.FormValue("before")
+	if beforeRev == "" {
+		beforeRev = after + "~"
+	}
+	before, err := resolve(beforeRev)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ev, err := f.pushEvent(owner, repo, ref, before, after)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp, err := f.deliver("push", payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+// deliver sends a webhook to the bot, signed like GitHub does.
+func (f *fakeGitHub) deliver(event string, payload []byte) (*http.Response, error) {
+	if f.webhook == "" {
+		return nil, fmt.Errorf("no webhook URL configured")
+	}
+	req, err := http.NewRequest("POST", f.webhook, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	delivery := make([]byte, 16)
+	_, _ = rand.Read(delivery)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitHub-Event", event)
+	req.Header.Set("X-GitHub-Delivery", hex.EncodeToString(delivery))
+	if len(f.secret) > 0 {
+		req.Header.Set("X-Hub-Signature-256", signGenericPayload(f.secret, payload))
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func fakeGitHubMain(args []string) {
+	fs := flag.NewFlagSet("fake-github", flag.ExitOnError)
+	port := fs.String("port", "9000", "port to listen on")
+	repos := fs.String("repos", ".", "directory of fixture repos, as <owner>/<repo>")
+	baseURL := fs.String("url", "", "address of the fake, for clone URLs (default http://localhost:<port>)")
+	webhook := fs.String("webhook", "http://localhost:8080/webhook", "bot webhook URL that pushes are sent to")
+	_ = fs.Parse(args)
+	if *baseURL == "" {
+		*baseURL = "http://localhost:" + *port
+	}
+	dir, err := filepath.Abs(*repos)
+	if err != nil {
+		log.Fatal(err)
+	}
+	f := &fakeGitHub{
+		repos:   dir,
+		url:     strings.TrimSuffix(*baseURL, "/"),
+		webhook: *webhook,
+		// the same secret the bot reads
+		secret: []byte(os.Getenv("WEBHOOK_SECRET")),
+	}
+	log.Printf("fake GitHub for %s at %s", dir, f.url)
+	log.Printf("run the bot with GITHUB_URL=%s and any GITHUB_APP_PRIVATE_KEY", f.url)
+	log.Fatal(http.ListenAndServe(":"+*port, f.handler()))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// force pushes
+//
+// git_multimail's ref change email for a non-fast-forward update mixes the
+// discarded commits in with the rest and explains the rewrite in a generic
+// paragraph. For these pushes the bot writes its own warning instead, with the
+// discarded and new commits listed separately and a range-diff of the
+// rewritten commits, which git_multimail_wrapper.py puts in place of that
+// paragraph.
+
+// forcePushEnv passes the warning to git_multimail_wrapper.py.
+const forcePushEnv = "COMMIT_EMAILS_FORCE_PUSH"
+
+const (
+	maxListedCommits  = 100
+	maxRangeDiffLines = 500
+	// a single environment variable is limited to 128KiB on Linux
+	maxForcePushNote = 100 << 10
+)
+
+// isForcePush reports whether a push removed commits from the ref, which is
+// the case when the before commit isn't an ancestor of the after commit.
+func isForcePush(gitDir string, push pushInfo) bool {
+	if push.Before == zeroSha || push.After == zeroSha {
+		return false
+	}
+	out, err := runGitCmd(gitDir, nil, "rev-list", "--count", push.After+".."+push.Before)
+	if err != nil {
+		return false
+	}
+	removed, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	return err == nil && removed > 0
+}
+
+// commitList is a one-line summary of each commit in a range, newest first.
+func commitList(gitDir string, revs ...string) ([]string, error) {
+	args := append([]string{"log", "--no-color", "--format=%h %s"}, revs...)
+	out, err := runGitCmd(gitDir, nil, args...)
+	if err != nil {
+		return nil, err
+	}
+	s := strings.TrimSpace(string(out))
+	if s == "" {
+		return nil, nil
+	}
+	return strings.Split(s, "\n"), nil
+}
+
+func writeCommitList(b *strings.Builder, title string, commits []string) {
+	fmt.Fprintf(b, "%s (%d):\n\n", title, len(commits))
+	if len(commits) == 0 {
+		b.WriteString("  (none)\n")
+	}
+	for i, c := range commits {
+		if i == maxListedCommits {
+			fmt.Fprintf(b, "  ... and %d more\n", len(commits)-i)
+			break
+		}
+		fmt.Fprintf(b, "  %s\n", c)
+	}
+	b.WriteString("\n")
+}
+
+// forcePushNote is the warning for a force push, or "" if the push is a
+// fast-forward. auth is needed for the range-diff in a partial clone, which
+// fetches file contents on demand.
+func forcePushNote(gitDir string, auth *gitAuth, push pushInfo) string {
+	if !isForcePush(gitDir, push) {
+		return ""
+	}
+	discarded, err := commitList(gitDir, push.After+".."+push.Before)
+	if err != nil {
+		return ""
+	}
+	added, err := commitList(gitDir, push.Before+".."+push.After)
+	if err != nil {
+		return ""
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `WARNING: this was a force push. %s was rewritten from %.8s to %.8s,
+and the discarded commits below are no longer on it (they are gone unless
+another branch or tag still has them).
+
+`, push.Ref, push.Before, push.After)
+	writeCommitList(&b, "Discarded commits", discarded)
+	writeCommitList(&b, "New commits", added)
+
+	// range-diff pairs up the old and new versions of rewritten commits; it
+	// fails if the two histories have nothing in common
+	out, err := runGitCmd(gitDir, auth, "range-diff", "--no-color", push.Before+"..."+push.After)
+	if err == nil && len(out) > 0 {
+		fmt.Fprintf(&b, "Comparison of the old and new commits (git range-diff %.8s...%.8s):\n\n", push.Before, push.After)
+		lines := strings.Split(strings.TrimRight(string(out), "\n"), "\n")
+		for i, line := range lines {
+			if i == maxRangeDiffLines {
+				fmt.Fprintf(&b, "[%d more lines]\n", len(lines)-i)
+				break
+			}
+			b.WriteString(line + "\n")
+		}
+	}
+	return truncate(b.String(), maxForcePushNote)
+}
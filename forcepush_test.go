@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestForcePushNote(t *testing.T) {
+	requireGit(t)
+	repo := newFixtureRepo(t)
+	base := repo.commit("Base")
+	repo.commit("Old one")
+	before := repo.commit("Old two")
+	repo.git("reset", "-q", "--hard", base)
+	repo.commit("Old one")
+	after := repo.commit("New two")
+	gitDir := repo.gitDir()
+
+	if note := forcePushNote(gitDir, nil, pushInfo{Before: base, After: before, Ref: "refs/heads/main"}); note != "" {
+		t.Errorf("fast-forward got a force push note:\n%s", note)
+	}
+	if isForcePush(gitDir, pushInfo{Before: zeroSha, After: after, Ref: "refs/heads/main"}) {
+		t.Error("created branch is a force push")
+	}
+
+	note := forcePushNote(gitDir, nil, pushInfo{Before: before, After: after, Ref: "refs/heads/main"})
+	for _, want := range []string{
+		"WARNING: this was a force push",
+		"Discarded commits (2):",
+		"Old two",
+		"New commits (2):",
+		"New two",
+		"git range-diff",
+	} {
+		if !strings.Contains(note, want) {
+			t.Errorf("force push note is missing %q:\n%s", want, note)
+		}
+	}
+}
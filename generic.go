@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// generic push webhook, for git servers without a forge
+//
+// The payload is a small JSON object describing one ref update, signed with
+// an HMAC-SHA256 of the body in X-Commit-Emails-Signature (as
+// "sha256=<hex>"). The post-receive subcommand sends these from a git hook.
+
+type genericPush struct {
+	// RepoURL is where the bot clones the repo from
+	RepoURL string `json:"repo_url"`
+	// Repo is a name for the repo; it defaults to the host and path of RepoURL
+	Repo string `json:"repo,omitempty"`
+	// CommitURL links to a commit, with {sha} replaced by the commit id
+	CommitURL string `json:"commit_url,omitempty"`
+	Ref       string `json:"ref"`
+	Before    string `json:"before"`
+	After     string `json:"after"`
+	Pusher    string `json:"pusher,omitempty"`
+}
+
+const genericSignatureHeader = "X-Commit-Emails-Signature"
+
+func parseGenericPush(payload []byte) (*genericPush, error) {
+	var push genericPush
+	if err := json.Unmarshal(payload, &push); err != nil {
+		return nil, err
+	}
+	if push.RepoURL == "" || push.Ref == "" || push.Before == "" || push.After == "" {
+		return nil, fmt.Errorf("push must have repo_url, ref, before, and after")
+	}
+	if err := checkCloneURL("repo_url", push.RepoURL); err != nil {
+		return nil, err
+	}
+	if push.Repo == "" {
+		u, _ := url.Parse(push.RepoURL)
+		push.Repo = u.Host + "/" + strings.TrimSuffix(strings.Trim(u.Path, "/"), ".git")
+		push.Repo = strings.TrimPrefix(push.Repo, "/")
+	}
+	return &push, nil
+}
+
+// account is the first component of the repo name after the host, for the
+// deny list.
+func (p *genericPush) account() string {
+	parts := strings.Split(p.Repo, "/")
+	if len(parts) < 3 {
+		return ""
+	}
+	return parts[1]
+}
+
+func (p *genericPush) remote() remotePush {
+	commitURL := strings.ReplaceAll(p.CommitURL, "%", "%%")
+	return remotePush{
+		Repo:     p.Repo,
+		CloneURL: p.RepoURL,
+		// the payload doesn't say how many commits there are, so shallow
+		// clones get a generous depth
+		Depth: 100,
+		Info: pushInfo{
+			Before:          p.Before,
+			After:           p.After,
+			Ref:             p.Ref,
+			CommitterName:   p.Pusher,
+			CommitBrowseURL: strings.ReplaceAll(commitURL, "{sha}", "%(id)s"),
+		},
+	}
+}
+
+func signGenericPayload(secret []byte, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (srv Server) genericEventHandler(w http.ResponseWriter, req *http.Request) {
+	if len(Cfg.GenericSecret) == 0 {
+		http.Error(w, "generic webhooks are not configured", http.StatusNotFound)
+		return
+	}
+	payload, err := io.ReadAll(io.LimitReader(req.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "could not read payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	signature, _ := strings.CutPrefix(req.Header.Get(genericSignatureHeader), "sha256=")
+	if !validHMAC(Cfg.GenericSecret, payload, signature) {
+		http.Error(w, "could not validate payload: invalid signature", http.StatusUnauthorized)
+		return
+	}
+	push, err := parseGenericPush(payload)
+	if err != nil {
+		http.Error(w, "could not parse webhook: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	delivery := jobID("")
+	logger := slog.With(slog.String("delivery", delivery))
+	if Cfg.Denied(push.account(), push.Repo, 0) {
+		logger.Info("denied push", slog.String("repo", push.Repo))
+		http.Error(w, "account denied", http.StatusForbidden)
+		return
+	}
+	srv.runRemoteJob(w, pushJob{
+		Delivery: delivery,
+		Source:   sourceGeneric,
+		Event:    "push",
+		Payload:  payload,
+		Received: time.Now(),
+	}, push.remote(), logger)
+}
+
+// gitConfigDefault reads a setting for the post-receive hook from the
+// repo's git config.
+func gitConfigDefault(key string) string {
+	out, err := exec.Command("git", "config", "--get", key).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// postReceiveMain implements a git post-receive hook that notifies the bot
+// about each updated ref.
+//
+// Settings come from flags or from the commitemails section of the repo's
+// git config. The secret is read from COMMIT_EMAILS_SECRET or
+// commitemails.secret rather than a flag, so it doesn't show up in the
+// process list.
+func postReceiveMain(args []string) {
+	fs := flag.NewFlagSet("post-receive", flag.ExitOnError)
+	server := fs.String("server", gitConfigDefault("commitemails.server"), "bot URL (eg, https://commit-emails.example.com)")
+	repoURL := fs.String("repo-url", gitConfigDefault("commitemails.repourl"), "URL the bot can clone this repo from")
+	repo := fs.String("repo", gitConfigDefault("commitemails.repo"), "name of the repo (defaults to the host and path of -repo-url)")
+	commitURL := fs.String("commit-url", gitConfigDefault("commitemails.commiturl"), "link to a commit, with {sha} for the commit id")
+	_ = fs.Parse(args)
+
+	secret := os.Getenv("COMMIT_EMAILS_SECRET")
+	if secret == "" {
+		secret = gitConfigDefault("commitemails.secret")
+	}
+	if *server == "" || *repoURL == "" || secret == "" {
+		log.Fatal("post-receive needs a server, repo URL, and secret")
+	}
+	pusher := os.Getenv("GL_USERNAME")
+	if pusher == "" {
+		pusher = os.Getenv("USER")
+	}
+
+	client := &http.Client{Timeout: 60 * time.Second}
+	failed := false
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		payload, err := json.Marshal(genericPush{
+			RepoURL:   *repoURL,
+			Repo:      *repo,
+			CommitURL: *commitURL,
+			Before:    fields[0],
+			After:     fields[1],
+			Ref:       fields[2],
+			Pusher:    pusher,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", strings.TrimSuffix(*server, "/")+"/webhook/generic", bytes.NewReader(payload))
+		if err != nil {
+			log.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(genericSignatureHeader, signGenericPayload([]byte(secret), payload))
+		resp, err := client.Do(req)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "commit-emails: %s: %v\n", fields[2], err)
+			failed = true
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			fmt.Fprintf(os.Stderr, "commit-emails: %s: %s: %s\n", fields[2], resp.Status, strings.TrimSpace(string(body)))
+			failed = true
+		}
+	}
+	// the push has already happened, so failures are only reported to the
+	// pusher rather than failing the hook
+	if failed {
+		fmt.Fprintln(os.Stderr, "commit-emails: some notifications were not sent")
+	}
+}
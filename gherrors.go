@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/go-github/v62/github"
+)
+
+// classifying GitHub API errors
+
+// PermissionError means the installation isn't allowed to read the repo, for
+// example because the owner hasn't accepted new permissions.
+type PermissionError struct {
+	Err error
+}
+
+func (e PermissionError) Error() string {
+	return fmt.Sprintf("permission denied by GitHub (check the app's installation permissions): %s", e.Err)
+}
+
+func (e PermissionError) Unwrap() error { return e.Err }
+
+// reportPermissionError tells the repo's owner that the installation can't
+// read the config, with an error status on the pushed commit (the config's
+// admin address can't be read either).
+func (h PushHandler) reportPermissionError(ctx context.Context, client *github.Client, ev *github.PushEvent, permErr PermissionError) {
+	if ev.GetAfter() == zeroSha {
+		return
+	}
+	err := postStatus(ctx, client, ev, "error", "commit-emails can't read .github/commit-emails.toml: check the app's permissions")
+	if err != nil {
+		h.log.Warn("setting permission error status", slog.String("error", err.Error()))
+		return
+	}
+	h.log.Info("reported permission error", slog.String("error", permErr.Error()))
+}
+
+// installationErrorsHandler lists the problems accessing each repo of an
+// installation (GET, with installation set to its id).
+func (srv Server) installationErrorsHandler(w http.ResponseWriter, req *http.Request) {
+	if !adminAuthorized(w, req) {
+		return
+	}
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	installation, err := strconv.ParseInt(req.FormValue("installation"), 10, 64)
+	if err != nil {
+		http.Error(w, "installation must be an installation id", http.StatusBadRequest)
+		return
+	}
+	errs, err := srv.db.InstallationErrors(installation)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(errs)
+}
+
+// TransientError is a failure that might succeed if retried: a GitHub
+// outage or a network problem.
+type TransientError struct {
+	Err error
+}
+
+func (e TransientError) Error() string {
+	return fmt.Sprintf("temporary GitHub error: %s", e.Err)
+}
+
+func (e TransientError) Unwrap() error { return e.Err }
+
+// classifyGitHubError sorts an error from the GitHub API into
+// MissingConfigError (the file is not there), PermissionError, or
+// TransientError. Other errors are returned as-is.
+func classifyGitHubError(err error) error {
+	var rateErr *github.RateLimitError
+	if errors.As(err, &rateErr) {
+		return fmt.Errorf("rate limit error: %s", err)
+	}
+	var abuseErr *github.AbuseRateLimitError
+	if errors.As(err, &abuseErr) {
+		return fmt.Errorf("abuse limit error: %s", err)
+	}
+	var respErr *github.ErrorResponse
+	if errors.As(err, &respErr) && respErr.Response != nil {
+		code := respErr.Response.StatusCode
+		switch {
+		case code == http.StatusNotFound:
+			return MissingConfigError{}
+		case code == http.StatusUnauthorized || code == http.StatusForbidden:
+			return PermissionError{Err: err}
+		case code >= 500:
+			return TransientError{Err: err}
+		}
+		return err
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return TransientError{Err: err}
+	}
+	return err
+}
+
+// retryTransient calls f until it succeeds, fails with a non-transient error,
+// or runs out of attempts.
+func retryTransient(ctx context.Context, attempts int, f func() error) error {
+	backoff := time.Second
+	for i := 1; ; i++ {
+		err := f()
+		var transient TransientError
+		if !errors.As(err, &transient) || i >= attempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tchajed/commit-emails-bot/stats"
+)
+
+func TestInstallationErrorsHandler(t *testing.T) {
+	db, err := stats.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedCfg := Cfg
+	t.Cleanup(func() { Cfg = savedCfg })
+	Cfg.AdminToken = "secret"
+	srv := Server{db: db}
+	db.AddInstallationError(12, "alice/proj", "permission denied")
+	db.AddInstallationError(12, "alice/other", "permission denied")
+	db.ClearInstallationError(12, "alice/other")
+	db.AddInstallationError(34, "bob/proj", "permission denied")
+
+	req := httptest.NewRequest("GET", "/admin/installation-errors?installation=12", nil)
+	rec := httptest.NewRecorder()
+	srv.installationErrorsHandler(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("request without the admin token returned %d", rec.Code)
+	}
+
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	srv.installationErrorsHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("returned %d: %s", rec.Code, rec.Body.String())
+	}
+	var errs map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &errs); err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 1 || errs["alice/proj"] != "permission denied" {
+		t.Errorf("installation errors are %v, want only alice/proj's", errs)
+	}
+}
@@ -2,83 +2,189 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/bradleyfalzon/ghinstallation/v2"
 	"github.com/google/go-github/v62/github"
 )
 
 func repoGitDir(persistPath string, repo *github.PushEventRepository) string {
-	return filepath.Join(persistPath, "repos", "github.com", *repo.FullName)
+	return filepath.Join(persistPath, "repos", Cfg.GitHubHost(), *repo.FullName)
 }
 
-// We authenticate to GitHub using an installation access token, acting as the
-// bot itself (not the user). The documentation suggests to do this with the URL
-// https://x-access-token:<token>@github.com/owner/repo.git, but this would
-// store that URL in the git config in plaintext. The tokens are valid for 1
-// hour, which is still a lot of exposure.
-//
-// Passing credentials via configuration, which we can pass by environment
-// variable, is a bit tricky, but git provides a "credential helper" which is a
-// program that gets credentials. We set that helper to a bash script that
-// echoes the constant token as the password (and a dummy username, which is
-// required), then pass it via the environment using git's GIT_CONFIG_*
-// variables (see runGitCmd)
-func tokenToCredentialHelper(token string) string {
-	return fmt.Sprintf("!f() { echo \"username=x-access-token\"; echo \"password=%s\"; }; f", token)
+// Repos can be cloned in full, or with less data for large repos: a partial
+// clone downloads all commits and trees but fetches file contents only when
+// a diff needs them, while a shallow clone only downloads history back to the
+// start of each push.
+const (
+	cloneFull    = "full"
+	clonePartial = "partial"
+	cloneShallow = "shallow"
+)
+
+func validCloneMode(mode string) bool {
+	return mode == cloneFull || mode == clonePartial || mode == cloneShallow
 }
 
-func tokenToParams(token string) []gitConfigParam {
-	return []gitConfigParam{{
-		Key:   "credential.helper",
-		Value: tokenToCredentialHelper(token),
-	}}
+// fetchOptions describes what needs to be fetched for a push.
+type fetchOptions struct {
+	mode   string
+	ref    string
+	before string // empty if the ref was created
+	after  string // empty if the ref was deleted
+	depth  int
 }
 
-func SyncRepo(ctx context.Context, client *github.Client, repo *github.PushEventRepository) (gitDir string, err error) {
-	_, _, _, err = client.Repositories.GetContents(ctx, *repo.Owner.Login, *repo.Name, ".github/commit-emails.toml", nil)
+const zeroSha = "0000000000000000000000000000000000000000"
+
+func pushFetchOptions(ev *github.PushEvent, mode string) fetchOptions {
+	opts := fetchOptions{mode: mode, ref: ev.GetRef()}
+	if before := ev.GetBefore(); before != zeroSha {
+		opts.before = before
+	}
+	if after := ev.GetAfter(); after != zeroSha {
+		opts.after = after
+	}
+	// the commits list in the payload is truncated, but size is the total
+	opts.depth = max(ev.GetSize(), len(ev.Commits)) + 1
+	return opts
+}
+
+// SyncRepo makes the local clone of the pushed repo up-to-date. auth is what
+// was needed to access the remote (nil if anonymous), which later git commands
+// also need in a partial clone.
+func (h PushHandler) SyncRepo(ctx context.Context, client *github.Client, ev *github.PushEvent) (gitDir string, auth *gitAuth, err error) {
+	repo := ev.GetRepo()
+	var content *github.RepositoryContent
+	err = retryTransient(ctx, 3, func() error {
+		var err error
+		content, _, _, err = client.Repositories.GetContents(ctx, *repo.Owner.Login, *repo.Name, ".github/commit-emails.toml", nil)
+		if err != nil {
+			err = classifyGitHubError(err)
+			var transient TransientError
+			if errors.As(err, &transient) {
+				h.log.Warn("checking for config", slog.String("error", err.Error()))
+			}
+		}
+		return err
+	})
 	if err != nil {
-		if _, ok := err.(*github.RateLimitError); ok {
-			return "", fmt.Errorf("rate limit error: %s", err)
+		var permErr PermissionError
+		if errors.As(err, &permErr) {
+			h.srv.db.AddInstallationError(h.installation, h.repo, err.Error())
+			h.reportPermissionError(ctx, client, ev, permErr)
 		}
-		if _, ok := err.(*github.AbuseRateLimitError); ok {
-			return "", fmt.Errorf("abuse limit error: %s", err)
+		return "", nil, err
+	}
+	h.srv.db.ClearInstallationError(h.installation, h.repo)
+	mode := Cfg.CloneMode
+	if text, err := content.GetContent(); err == nil {
+		// errors in the config are reported once it is read from the clone
+		if config, err := parseConfig([]byte(text)); err == nil && config.Git.Clone != "" {
+			mode = config.Git.Clone
 		}
-		// TODO: only do this for 404
-		return "", MissingConfigError{}
 	}
+	opts := pushFetchOptions(ev, mode)
 
-	// TODO: might not want to authenticate for public repos
+	gitDir = repoGitDir(Cfg.PersistPath, repo)
+	// public repos are fetched anonymously, which keeps the token out of git
+	// and of the later git commands. If that fails (eg, the repo was just
+	// made private) the fetch is retried with the token before the clone is
+	// suspected of being broken.
+	if !repo.GetPrivate() {
+		err = h.fetchGitDir(ctx, gitDir, repo.GetCloneURL(), nil, opts)
+		if err == nil {
+			return gitDir, nil, nil
+		}
+		h.log.Info("anonymous fetch failed, retrying with token", slog.String("error", err.Error()))
+	}
 	itr := client.Client().Transport.(*ghinstallation.Transport)
 	token, err := itr.Token(ctx)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
-	params := tokenToParams(token)
+	auth = newGitAuth("x-access-token", token, repo.GetCloneURL())
+	if err := h.syncGitDir(ctx, gitDir, repo.GetCloneURL(), auth, opts); err != nil {
+		return "", nil, err
+	}
+	return gitDir, auth, nil
+}
 
-	gitDir = repoGitDir(Cfg.PersistPath, repo)
+// fetchGitDir clones or fetches into gitDir. An existing clone of a different
+// URL (say, a generic push's repo_url changed) is replaced.
+func (h PushHandler) fetchGitDir(ctx context.Context, gitDir string, url string, auth *gitAuth, opts fetchOptions) error {
 	fi, err := os.Stat(gitDir)
+	if err == nil && fi.IsDir() {
+		// a clone that is broken enough not to have an origin is recovered
+		// by syncGitDir instead
+		if origin := gitOriginURL(gitDir); origin != "" && origin != url {
+			h.log.Warn("clone URL changed, re-cloning",
+				slog.String("old", origin),
+				slog.String("new", url))
+			if err := os.RemoveAll(gitDir); err != nil {
+				return err
+			}
+			fi, err = os.Stat(gitDir)
+		}
+	}
 	if os.IsNotExist(err) {
-		err := gitClone(*repo.CloneURL, gitDir, params)
+		err := gitClone(ctx, url, gitDir, auth, opts.mode)
 		if err != nil {
-			return "", err
+			return err
 		}
-		slog.Info("clone", slog.String("repo", *repo.FullName))
+		h.log.Info("clone", slog.String("mode", opts.mode))
 	} else if err != nil {
-		return "", err
+		return err
 	} else if !fi.IsDir() {
-		return "", fmt.Errorf("%s exists and is not a directory", gitDir)
+		return fmt.Errorf("%s exists and is not a directory", gitDir)
 	}
 
-	err = gitFetch(gitDir, params)
+	stats, err := gitFetch(ctx, gitDir, auth, opts)
 	if err != nil {
-		return
+		return err
 	}
-	return
+	h.log.Info("fetch", stats.attrs()...)
+	return nil
+}
+
+// syncGitDir clones or fetches into gitDir, re-cloning if the existing clone
+// is broken.
+func (h PushHandler) syncGitDir(ctx context.Context, gitDir string, url string, auth *gitAuth, opts fetchOptions) error {
+	err := h.fetchGitDir(ctx, gitDir, url, auth, opts)
+	if err == nil {
+		return nil
+	}
+	// the fetch might have failed for reasons unrelated to the local repo
+	// (eg, the network), so only re-clone if the repo is actually broken
+	checkErr := gitCheckRepo(gitDir)
+	if checkErr == nil {
+		return err
+	}
+	h.log.Warn("corrupt repo, re-cloning",
+		slog.String("fetch error", err.Error()),
+		slog.String("check error", checkErr.Error()))
+	h.srv.db.AddRecovery(h.repo, checkErr.Error())
+	if err := os.RemoveAll(gitDir); err != nil {
+		return err
+	}
+	if err := gitClone(ctx, url, gitDir, auth, opts.mode); err != nil {
+		return err
+	}
+	h.log.Info("clone", slog.String("mode", opts.mode), slog.Bool("recovery", true))
+	stats, err := gitFetch(ctx, gitDir, auth, opts)
+	if err != nil {
+		return err
+	}
+	h.log.Info("fetch", stats.attrs()...)
+	return nil
 }
 
 // GitShow fetches the contents of a file
@@ -91,35 +197,217 @@ type gitConfigParam struct {
 	Value string
 }
 
-func gitClone(url string, dest string, params []gitConfigParam) error {
-	_, err := runGitCmd(dest, params, "clone", "--bare", "--quiet", url, dest)
+// gitClone clones into a temporary directory and renames it to dest once the
+// clone is complete, so an interrupted clone never leaves a partial repo at
+// dest.
+func gitClone(ctx context.Context, url string, dest string, auth *gitAuth, mode string) error {
+	parent, base := filepath.Split(dest)
+	if err := os.MkdirAll(parent, 0770); err != nil {
+		return err
+	}
+	// clean up after any clones that were interrupted
+	stale, _ := filepath.Glob(filepath.Join(parent, base+".clone-*"))
+	for _, dir := range stale {
+		_ = os.RemoveAll(dir)
+	}
+	tmp, err := os.MkdirTemp(parent, base+".clone-")
+	if err != nil {
+		return err
+	}
+	args := []string{"clone", "--bare", "--quiet"}
+	switch mode {
+	case clonePartial:
+		args = append(args, "--filter=blob:none")
+	case cloneShallow:
+		// the fetch after cloning deepens history as far as the push needs
+		args = append(args, "--depth=1")
+	}
+	_, err = runGitCmdContext(ctx, tmp, auth, append(args, url, tmp)...)
+	if err != nil {
+		_ = os.RemoveAll(tmp)
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
+
+// gitOriginURL is the URL a clone was made from, or "" if it can't be read.
+func gitOriginURL(gitDir string) string {
+	out, err := runGitCmd(gitDir, nil, "config", "--get", "remote.origin.url")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// gitCheckRepo checks that a bare repo is intact.
+func gitCheckRepo(gitDir string) error {
+	_, err := runGitCmd(gitDir, nil, "fsck", "--connectivity-only", "--no-dangling", "--no-progress")
 	return err
 }
 
-func gitFetch(gitDir string, params []gitConfigParam) error {
-	_, err := runGitCmd(gitDir, params, "fetch", "--quiet", "--force", "origin", "*:*")
+// fetchStats summarizes a fetch for logging.
+type fetchStats struct {
+	scope    string // "ref" if only the pushed ref was fetched, "all" for every ref
+	duration time.Duration
+	bytes    int64 // growth of the object store
+}
+
+func (s fetchStats) attrs() []any {
+	return []any{
+		slog.String("scope", s.scope),
+		slog.Duration("duration", s.duration),
+		slog.Int64("bytes", s.bytes),
+	}
+}
+
+// gitFetch fetches what the push needs: normally just the pushed ref (and its
+// before commit), falling back to fetching every ref when that fails or when
+// the push creates a ref (since git_multimail needs the other refs to be
+// current to tell which commits on the new ref are new). A deleted ref is
+// removed from the clone.
+func gitFetch(ctx context.Context, gitDir string, auth *gitAuth, opts fetchOptions) (fetchStats, error) {
+	start := time.Now()
+	sizeBefore := gitObjectsSize(gitDir)
+	scope, err := gitFetchRefs(ctx, gitDir, auth, opts)
+	return fetchStats{
+		scope:    scope,
+		duration: time.Since(start),
+		bytes:    gitObjectsSize(gitDir) - sizeBefore,
+	}, err
+}
+
+func gitFetchRefs(ctx context.Context, gitDir string, auth *gitAuth, opts fetchOptions) (scope string, err error) {
+	if opts.before != "" || opts.mode == cloneShallow {
+		err := gitFetchPushedRef(ctx, gitDir, auth, opts)
+		// a shallow fetch of every ref would download far more than needed
+		if err == nil || opts.mode == cloneShallow {
+			return "ref", err
+		}
+	}
+	_, err = runGitCmdContext(ctx, gitDir, auth, "fetch", "--quiet", "--force", "--prune", "origin", "*:*")
+	if err != nil {
+		return "all", err
+	}
+	return "all", gitFetchCommit(ctx, gitDir, auth, opts.before, nil)
+}
+
+func gitFetchPushedRef(ctx context.Context, gitDir string, auth *gitAuth, opts fetchOptions) error {
+	var depthArgs []string
+	if opts.mode == cloneShallow {
+		// deep enough to include every commit in the push
+		depthArgs = []string{fmt.Sprintf("--depth=%d", opts.depth)}
+	}
+	if opts.after != "" {
+		args := append([]string{"fetch", "--quiet", "--force"}, depthArgs...)
+		args = append(args, "origin", fmt.Sprintf("+%s:%s", opts.ref, opts.ref))
+		if _, err := runGitCmdContext(ctx, gitDir, auth, args...); err != nil {
+			return err
+		}
+	}
+	if opts.mode == cloneShallow {
+		depthArgs = []string{"--depth=1"}
+	}
+	if err := gitFetchCommit(ctx, gitDir, auth, opts.before, depthArgs); err != nil {
+		return err
+	}
+	if opts.after == "" {
+		// a deleted branch mustn't count as one that later new branches'
+		// commits are already on (its commit stays for the push's email)
+		if _, err := runGitCmd(gitDir, nil, "update-ref", "-d", opts.ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gitFetchCommit makes sure a commit is present, eg the before commit of a
+// force push, which is no longer on any ref.
+func gitFetchCommit(ctx context.Context, gitDir string, auth *gitAuth, commit string, extraArgs []string) error {
+	if commit == "" || gitHasCommit(gitDir, commit) {
+		return nil
+	}
+	args := append([]string{"fetch", "--quiet"}, extraArgs...)
+	_, err := runGitCmdContext(ctx, gitDir, auth, append(args, "origin", commit)...)
 	return err
 }
 
-func runGitCmd(gitDir string, params []gitConfigParam, args ...string) ([]byte, error) {
-	cmd := exec.Command("git", args...)
-	cmd.Env = os.Environ()
-	cmd.Env = append(cmd.Env, "GIT_DIR="+gitDir)
-	// GIT_CONFIG_COUNT, GIT_CONFIG_KEY_<n>, GIT_CONFIG_VALUE_<n>, ... are a
-	// feature to pass configuration options by environment variables. There's
-	// also GIT_CONFIG_PARAMETERS, but it's hard to encode arbitrary values with
-	// spaces in that.
-	cmd.Env = append(cmd.Env, fmt.Sprintf("GIT_CONFIG_COUNT=%d", len(params)))
+func gitHasCommit(gitDir string, commit string) bool {
+	_, err := runGitCmd(gitDir, nil, "cat-file", "-e", commit+"^{commit}")
+	return err == nil
+}
+
+// gitObjectsSize returns the size of the object store in bytes, or 0 if it
+// can't be determined.
+func gitObjectsSize(gitDir string) int64 {
+	out, err := runGitCmd(gitDir, nil, "count-objects", "-v")
+	if err != nil {
+		return 0
+	}
+	var total int64
+	for _, line := range strings.Split(string(out), "\n") {
+		key, val, ok := strings.Cut(line, ": ")
+		if !ok || !(key == "size" || key == "size-pack") {
+			continue
+		}
+		kib, err := strconv.ParseInt(val, 10, 64)
+		if err == nil {
+			total += kib * 1024
+		}
+	}
+	return total
+}
+
+// gitConfigEnv passes config params to git through the environment.
+//
+// GIT_CONFIG_COUNT, GIT_CONFIG_KEY_<n>, GIT_CONFIG_VALUE_<n>, ... are a
+// feature to pass configuration options by environment variables. There's
+// also GIT_CONFIG_PARAMETERS, but it's hard to encode arbitrary values with
+// spaces in that.
+func gitConfigEnv(params []gitConfigParam) []string {
+	env := []string{fmt.Sprintf("GIT_CONFIG_COUNT=%d", len(params))}
 	for i, p := range params {
-		cmd.Env = append(cmd.Env,
+		env = append(env,
 			fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", i, p.Key),
 			fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", i, p.Value),
 		)
 	}
+	return env
+}
+
+// gitError is a git command that exited with an error.
+type gitError struct {
+	args   []string
+	state  string
+	stderr string
+}
+
+func (e gitError) Error() string {
+	return fmt.Sprintf("git %v failed: %s: %q", e.args, e.state, e.stderr)
+}
+
+func runGitCmd(gitDir string, auth *gitAuth, args ...string) ([]byte, error) {
+	return runGitCmdContext(context.Background(), gitDir, auth, args...)
+}
+
+// runGitCmdContext is runGitCmd for commands that can take a while (clones
+// and fetches), which are stopped if ctx is canceled.
+func runGitCmdContext(ctx context.Context, gitDir string, auth *gitAuth, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	// git's helpers (eg, git-remote-https) can hold its output open after
+	// it's killed
+	cmd.WaitDelay = time.Second
+	cmd.Env = os.Environ()
+	cmd.Env = append(cmd.Env, "GIT_DIR="+gitDir)
+	// never wait for a password on the terminal
+	cmd.Env = append(cmd.Env, "GIT_TERMINAL_PROMPT=0")
+	cmd.Env = append(cmd.Env, auth.env()...)
 	out, err := cmd.Output()
+	if err != nil && ctx.Err() != nil {
+		return out, fmt.Errorf("git %s: %w", args[0], ctx.Err())
+	}
 	if err != nil {
 		if ee, ok := err.(*exec.ExitError); ok {
-			return out, fmt.Errorf("git %v failed: %s: %q", args, ee.ProcessState.String(), ee.Stderr)
+			return out, gitError{args: args, state: ee.ProcessState.String(), stderr: string(ee.Stderr)}
 		}
 	}
 	return out, err
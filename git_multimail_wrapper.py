@@ -1,6 +1,7 @@
 #! /usr/bin/env python3
 
 import git_multimail
+import os
 import sys
 
 git_multimail.REFCHANGE_INTRO_TEMPLATE = ""
@@ -50,6 +51,13 @@ git_multimail.COMBINED_REFCHANGE_REVISION_SUBJECT_TEMPLATE = (
     '%(emailprefix)s%(short_refname)s: %(oneline)s'
 )
 
+# For a force push the bot passes its own warning, listing the discarded and
+# new commits with a range-diff, in place of the generic explanation.
+force_push = os.environ.get("COMMIT_EMAILS_FORCE_PUSH")
+if force_push:
+    git_multimail.NON_FF_TEMPLATE = "\n" + force_push.replace("%", "%%")
+    git_multimail.REWIND_ONLY_TEMPLATE = git_multimail.NON_FF_TEMPLATE
+
 
 if __name__ == "__main__":
     git_multimail.main(sys.argv[1:])
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Gitea and Forgejo webhooks
+//
+// Gitea's push payload is modeled on GitHub's, but it's signed differently
+// (a bare hex HMAC in X-Gitea-Signature) and the repo has no app
+// installation, so it goes through the remote push pipeline.
+
+type giteaPush struct {
+	Ref        string `json:"ref"`
+	Before     string `json:"before"`
+	After      string `json:"after"`
+	Repository struct {
+		FullName string `json:"full_name"`
+		CloneURL string `json:"clone_url"`
+		HTMLURL  string `json:"html_url"`
+		Private  bool   `json:"private"`
+		Owner    struct {
+			Login    string `json:"login"`
+			Username string `json:"username"`
+		} `json:"owner"`
+	} `json:"repository"`
+	Commits []struct {
+		ID        string `json:"id"`
+		Committer struct {
+			Name string `json:"name"`
+		} `json:"committer"`
+	} `json:"commits"`
+	TotalCommits int `json:"total_commits"`
+	Pusher       struct {
+		FullName string `json:"full_name"`
+		Login    string `json:"login"`
+	} `json:"pusher"`
+}
+
+func parseGiteaPush(payload []byte) (*giteaPush, error) {
+	var push giteaPush
+	if err := json.Unmarshal(payload, &push); err != nil {
+		return nil, err
+	}
+	if push.Repository.FullName == "" || push.Repository.CloneURL == "" {
+		return nil, fmt.Errorf("gitea push is missing repository information")
+	}
+	if err := checkCloneURL("clone_url", push.Repository.CloneURL); err != nil {
+		return nil, err
+	}
+	if err := checkServerURL(Cfg.GiteaURL, push.Repository.CloneURL); err != nil {
+		return nil, fmt.Errorf("gitea push from another server: %w", err)
+	}
+	return &push, nil
+}
+
+func (p *giteaPush) account() string {
+	if p.Repository.Owner.Login != "" {
+		return p.Repository.Owner.Login
+	}
+	return p.Repository.Owner.Username
+}
+
+func (p *giteaPush) remote() remotePush {
+	host := "gitea"
+	if u, err := url.Parse(p.Repository.CloneURL); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	committer := p.Pusher.FullName
+	for _, c := range p.Commits {
+		if c.ID == p.After {
+			committer = c.Committer.Name
+		}
+	}
+	push := remotePush{
+		Repo:     host + "/" + p.Repository.FullName,
+		CloneURL: p.Repository.CloneURL,
+		Depth:    max(p.TotalCommits, len(p.Commits)) + 1,
+		Info: pushInfo{
+			Before:          p.Before,
+			After:           p.After,
+			Ref:             p.Ref,
+			CommitterName:   committer,
+			CommitBrowseURL: p.Repository.HTMLURL + "/commit/%(id)s",
+		},
+	}
+	// the token is only for GITEA_URL, which parseGiteaPush checked
+	if Cfg.GiteaToken != "" && Cfg.GiteaURL != "" && p.Repository.Private {
+		push.Auth = newGitAuth("oauth2", Cfg.GiteaToken, p.Repository.CloneURL)
+	}
+	return push
+}
+
+// validHMAC checks a hex-encoded HMAC-SHA256 signature of payload.
+func validHMAC(secret []byte, payload []byte, signature string) bool {
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+func (srv Server) giteaEventHandler(w http.ResponseWriter, req *http.Request) {
+	if len(Cfg.GiteaSecret) == 0 {
+		http.Error(w, "Gitea webhooks are not configured", http.StatusNotFound)
+		return
+	}
+	payload, err := io.ReadAll(io.LimitReader(req.Body, 25<<20))
+	if err != nil {
+		http.Error(w, "could not read payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Forgejo sends both its own headers and Gitea's
+	signature := req.Header.Get("X-Gitea-Signature")
+	if signature == "" {
+		signature = req.Header.Get("X-Forgejo-Signature")
+	}
+	if !validHMAC(Cfg.GiteaSecret, payload, signature) {
+		http.Error(w, "could not validate payload: invalid signature", http.StatusUnauthorized)
+		return
+	}
+	eventType := req.Header.Get("X-Gitea-Event")
+	if eventType != "push" {
+		_, _ = w.Write([]byte("ignored"))
+		return
+	}
+	push, err := parseGiteaPush(payload)
+	if err != nil {
+		http.Error(w, "could not parse webhook: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	delivery := jobID(req.Header.Get("X-Gitea-Delivery"))
+	logger := slog.With(slog.String("delivery", delivery))
+	if Cfg.Denied(push.account(), push.Repository.FullName, 0) {
+		logger.Info("denied push",
+			slog.String("account", push.account()),
+			slog.String("repo", push.Repository.FullName))
+		http.Error(w, "account denied", http.StatusForbidden)
+		return
+	}
+	srv.runRemoteJob(w, pushJob{
+		Delivery: delivery,
+		Source:   sourceGitea,
+		Event:    eventType,
+		Payload:  payload,
+		Received: time.Now(),
+	}, push.remote(), logger)
+}
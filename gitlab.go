@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// GitLab webhooks
+//
+// A GitLab project (or group) sends push and tag push events to
+// /webhook/gitlab, authenticated with a shared secret in X-Gitlab-Token. The
+// repo is cloned and its commit-emails.toml is read from the clone (see
+// remote.go), then emails go through the same pipeline as GitHub pushes.
+
+// gitlabPush is the part of GitLab's push and tag push event payloads that the
+// bot uses.
+type gitlabPush struct {
+	ObjectKind string `json:"object_kind"`
+	Before     string `json:"before"`
+	After      string `json:"after"`
+	Ref        string `json:"ref"`
+	UserName   string `json:"user_name"`
+	ProjectID  int64  `json:"project_id"`
+	Project    struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+		WebURL            string `json:"web_url"`
+		GitHTTPURL        string `json:"git_http_url"`
+		// 0 is private, 10 internal, and 20 public
+		VisibilityLevel int `json:"visibility_level"`
+	} `json:"project"`
+	Commits []struct {
+		ID     string `json:"id"`
+		Author struct {
+			Name string `json:"name"`
+		} `json:"author"`
+	} `json:"commits"`
+}
+
+func parseGitlabPush(payload []byte) (*gitlabPush, error) {
+	var push gitlabPush
+	if err := json.Unmarshal(payload, &push); err != nil {
+		return nil, err
+	}
+	if !(push.ObjectKind == "push" || push.ObjectKind == "tag_push") {
+		return nil, fmt.Errorf("unsupported GitLab event %q", push.ObjectKind)
+	}
+	if push.Project.PathWithNamespace == "" || push.Project.GitHTTPURL == "" {
+		return nil, fmt.Errorf("GitLab push is missing project information")
+	}
+	if err := checkCloneURL("git_http_url", push.Project.GitHTTPURL); err != nil {
+		return nil, err
+	}
+	if err := checkServerURL(Cfg.GitlabURL, push.Project.GitHTTPURL); err != nil {
+		return nil, fmt.Errorf("GitLab push from another server: %w", err)
+	}
+	return &push, nil
+}
+
+func (p *gitlabPush) host() string {
+	u, err := url.Parse(p.Project.GitHTTPURL)
+	if err != nil || u.Host == "" {
+		return "gitlab"
+	}
+	return u.Host
+}
+
+// account is the project's top-level group or user, for the deny list. The
+// payload's namespace field is a display name, so it's taken from the path.
+func (p *gitlabPush) account() string {
+	return strings.Split(p.Project.PathWithNamespace, "/")[0]
+}
+
+// repoName identifies the project, including the host so it can't be
+// confused with a GitHub repo.
+func (p *gitlabPush) repoName() string {
+	return p.host() + "/" + p.Project.PathWithNamespace
+}
+
+func (p *gitlabPush) remote() remotePush {
+	committer := p.UserName
+	for _, c := range p.Commits {
+		if c.ID == p.After {
+			committer = c.Author.Name
+		}
+	}
+	push := remotePush{
+		Repo:     p.repoName(),
+		CloneURL: p.Project.GitHTTPURL,
+		Depth:    len(p.Commits) + 1,
+		Info: pushInfo{
+			Before:          p.Before,
+			After:           p.After,
+			Ref:             p.Ref,
+			CommitterName:   committer,
+			CommitBrowseURL: p.Project.WebURL + "/-/commit/%(id)s",
+		},
+	}
+	// the token is only for GITLAB_URL, which parseGitlabPush checked
+	if Cfg.GitlabToken != "" && Cfg.GitlabURL != "" && p.Project.VisibilityLevel != 20 {
+		// GitLab accepts any username with a personal or project access token
+		push.Auth = newGitAuth("oauth2", Cfg.GitlabToken, p.Project.GitHTTPURL)
+	}
+	return push
+}
+
+func (srv Server) gitlabEventHandler(w http.ResponseWriter, req *http.Request) {
+	if len(Cfg.GitlabSecret) == 0 {
+		http.Error(w, "GitLab webhooks are not configured", http.StatusNotFound)
+		return
+	}
+	token := []byte(req.Header.Get("X-Gitlab-Token"))
+	if subtle.ConstantTimeCompare(token, Cfg.GitlabSecret) != 1 {
+		http.Error(w, "invalid X-Gitlab-Token", http.StatusUnauthorized)
+		return
+	}
+	payload, err := io.ReadAll(io.LimitReader(req.Body, 25<<20))
+	if err != nil {
+		http.Error(w, "could not read payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	eventType := req.Header.Get("X-Gitlab-Event")
+	if !(eventType == "Push Hook" || eventType == "Tag Push Hook") {
+		// other events are accepted but ignored, like GitHub's
+		_, _ = w.Write([]byte("ignored"))
+		return
+	}
+	push, err := parseGitlabPush(payload)
+	if err != nil {
+		http.Error(w, "could not parse webhook: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	delivery := jobID(req.Header.Get("X-Gitlab-Event-UUID"))
+	logger := slog.With(slog.String("delivery", delivery))
+	if Cfg.Denied(push.account(), push.Project.PathWithNamespace, 0) {
+		logger.Info("denied push",
+			slog.String("account", push.account()),
+			slog.String("repo", push.repoName()))
+		http.Error(w, "account denied", http.StatusForbidden)
+		return
+	}
+	srv.runRemoteJob(w, pushJob{
+		Delivery: delivery,
+		Source:   sourceGitLab,
+		Event:    eventType,
+		Payload:  payload,
+		Received: time.Now(),
+	}, push.remote(), logger)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/bradleyfalzon/ghinstallation/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// health and readiness checks for the orchestrator
+
+// smtpCheckInterval is how long a check of the SMTP server is reused, so
+// frequent probes don't turn into connections to the mail provider.
+const smtpCheckInterval = time.Minute
+
+type checkResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+func writeHealth(w http.ResponseWriter, report healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// healthzHandler only reports that the process is up and serving requests.
+func (srv Server) healthzHandler(w http.ResponseWriter, req *http.Request) {
+	writeHealth(w, healthReport{Status: "ok"})
+}
+
+// readyzHandler checks the dependencies needed to handle a push. A server
+// that is shutting down isn't ready, since it rejects pushes.
+func (srv Server) readyzHandler(w http.ResponseWriter, req *http.Request) {
+	if srv.jobs.isDraining() {
+		writeHealth(w, healthReport{Status: "draining"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), 10*time.Second)
+	defer cancel()
+	checks := map[string]func(context.Context) error{
+		"database":   srv.db.Ping,
+		"persist":    checkPersistWritable,
+		"git":        checkGit,
+		"mail":       srv.mailCheck.check,
+		"github_app": checkAppCredentials,
+	}
+	report := healthReport{Status: "ok", Checks: make(map[string]checkResult)}
+	for name, check := range checks {
+		if err := check(ctx); err != nil {
+			report.Status = "fail"
+			report.Checks[name] = checkResult{OK: false, Error: err.Error()}
+			continue
+		}
+		report.Checks[name] = checkResult{OK: true}
+	}
+	writeHealth(w, report)
+}
+
+func checkPersistWritable(ctx context.Context) error {
+	f, err := os.CreateTemp(Cfg.PersistPath, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	_, err = f.Write([]byte("ok"))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if removeErr := os.Remove(name); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+func checkGit(ctx context.Context) error {
+	out, err := exec.CommandContext(ctx, "git", "--version").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git --version: %w: %s", err, out)
+	}
+	return nil
+}
+
+// mailCheck makes sure git_multimail can run and, if emails are actually
+// sent, that the SMTP server is reachable. git_multimail is only checked once,
+// at startup, since installing it needs a restart anyway.
+type mailCheck struct {
+	multimail error
+
+	mu          sync.Mutex
+	smtpChecked time.Time
+	smtp        error
+}
+
+func newMailCheck() *mailCheck {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return &mailCheck{multimail: checkMultimail(ctx)}
+}
+
+func checkMultimail(ctx context.Context) error {
+	if _, err := os.Stat("git_multimail_wrapper.py"); err != nil {
+		return err
+	}
+	out, err := exec.CommandContext(ctx, "python3", "-c", "import git_multimail").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("importing git_multimail: %w: %s", err, out)
+	}
+	return nil
+}
+
+func (m *mailCheck) check(ctx context.Context) error {
+	if m.multimail != nil {
+		return m.multimail
+	}
+	if Cfg.SmtpPassword == "" {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if time.Since(m.smtpChecked) < smtpCheckInterval {
+		return m.smtp
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", smtpServer)
+	if err == nil {
+		err = conn.Close()
+	}
+	m.smtp, m.smtpChecked = err, time.Now()
+	return err
+}
+
+// checkAppCredentials signs a GitHub App JWT without sending it anywhere.
+func checkAppCredentials(ctx context.Context) error {
+	if Cfg.AppId == 0 {
+		return fmt.Errorf("GITHUB_APP_ID is not set")
+	}
+	key, err := jwt.ParseRSAPrivateKeyFromPEM(Cfg.AppPrivateKey)
+	if err != nil {
+		return fmt.Errorf("could not parse private key: %w", err)
+	}
+	now := time.Now()
+	signer := ghinstallation.NewRSASigner(jwt.SigningMethodRS256, key)
+	_, err = signer.Sign(&jwt.RegisteredClaims{
+		IssuedAt:  jwt.NewNumericDate(now.Add(-30 * time.Second)),
+		ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+		Issuer:    fmt.Sprintf("%d", Cfg.AppId),
+	})
+	return err
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadyzDraining(t *testing.T) {
+	jobs, err := newJobTracker(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := Server{jobs: jobs}
+	if err := jobs.drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	srv.readyzHandler(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("readyz while draining returned %d, want 503", rec.Code)
+	}
+}
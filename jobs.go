@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v62/github"
+)
+
+// tracking in-flight push jobs
+//
+// Every push is written to persist/pending before it is processed and removed
+// once it finishes. The saved job also counts the push's emails as they are
+// sent, so a push that is resumed (or retried) only sends the rest. On
+// shutdown the server stops accepting pushes and waits for the in-flight ones;
+// at the drain deadline their context is canceled, and they are left in
+// pending and resumed on the next start.
+
+// pushTimeout bounds a single push. It's longer than the default drain
+// timeout, which cancels pushes on shutdown.
+const pushTimeout = 10 * time.Minute
+
+// Where a push came from. GitHub is the default, so jobs saved before there
+// were other sources have an empty source.
+const (
+	sourceGitHub  = ""
+	sourceGitLab  = "gitlab"
+	sourceGitea   = "gitea"
+	sourceGeneric = "generic"
+)
+
+// pushJob is a webhook delivery saved to disk.
+type pushJob struct {
+	Delivery string          `json:"delivery"`
+	Source   string          `json:"source,omitempty"`
+	Event    string          `json:"event"`
+	Payload  json.RawMessage `json:"payload"`
+	Received time.Time       `json:"received"`
+	// Sent is how many of the push's emails have been sent
+	Sent int `json:"sent,omitempty"`
+}
+
+func (j pushJob) githubEvent() (*github.PushEvent, error) {
+	event, err := github.ParseWebHook(j.Event, j.Payload)
+	if err != nil {
+		return nil, err
+	}
+	push, ok := event.(*github.PushEvent)
+	if !ok {
+		return nil, fmt.Errorf("job %s is a %s event, not a push", j.Delivery, j.Event)
+	}
+	return push, nil
+}
+
+func writeJob(dir string, job pushJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, job.Delivery+".json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0660); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readJobs(dir string) ([]pushJob, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []pushJob
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var job pushJob
+		if err := json.Unmarshal(data, &job); err != nil {
+			return nil, fmt.Errorf("%s: %w", e.Name(), err)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// jobID returns a name for a delivery that is safe to use as a file name.
+func jobID(delivery string) string {
+	valid := delivery != ""
+	for _, c := range delivery {
+		if !(c == '-' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') {
+			valid = false
+		}
+	}
+	if valid {
+		return delivery
+	}
+	return fmt.Sprintf("local-%d", time.Now().UnixNano())
+}
+
+var errDraining = errors.New("server is shutting down")
+
+type jobTracker struct {
+	dir string
+	// ctx is the parent of every push's context, canceled when draining
+	// times out
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	draining bool
+	wg       sync.WaitGroup
+}
+
+func newJobTracker(persistPath string) (*jobTracker, error) {
+	dir := filepath.Join(persistPath, "pending")
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &jobTracker{dir: dir, ctx: ctx, cancel: cancel}, nil
+}
+
+// pushContext is the context for running a push.
+func (t *jobTracker) pushContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(t.ctx, pushTimeout)
+}
+
+// interrupted reports whether jobs are being stopped by shutdown, in which
+// case a job that fails is resumed on the next start rather than failed.
+func (t *jobTracker) interrupted() bool {
+	return t.ctx.Err() != nil
+}
+
+// start records job as in progress. The returned function must be called
+// with the job's result when it finishes.
+func (t *jobTracker) start(job pushJob) (done func(error), err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return nil, errDraining
+	}
+	if err := writeJob(t.dir, job); err != nil {
+		return nil, fmt.Errorf("saving pending job: %w", err)
+	}
+	t.wg.Add(1)
+	return func(jobErr error) {
+		defer t.wg.Done()
+		if jobErr != nil && t.interrupted() {
+			slog.Info("leaving interrupted push to resume", slog.String("delivery", job.Delivery))
+			return
+		}
+		err := os.Remove(filepath.Join(t.dir, job.Delivery+".json"))
+		if err != nil {
+			slog.Warn("removing pending job",
+				slog.String("delivery", job.Delivery),
+				slog.String("error", err.Error()))
+		}
+	}, nil
+}
+
+// save records the progress of a job that was started.
+func (t *jobTracker) save(job pushJob) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return writeJob(t.dir, job)
+}
+
+func (t *jobTracker) isDraining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+// drain stops accepting new jobs and waits for in-flight ones until ctx is
+// done.
+func (t *jobTracker) drain(ctx context.Context) error {
+	t.mu.Lock()
+	t.draining = true
+	t.mu.Unlock()
+	finished := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+	}
+	// stop the remaining pushes, and give them a moment to save where they
+	// got to
+	t.cancel()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+	}
+	return ctx.Err()
+}
+
+// resumePending re-runs pushes that were interrupted by the last shutdown.
+func (srv Server) resumePending() {
+	jobs, err := readJobs(srv.jobs.dir)
+	if err != nil {
+		slog.Error("reading pending jobs", slog.String("error", err.Error()))
+		return
+	}
+	for _, job := range jobs {
+		logger := slog.With(slog.String("delivery", job.Delivery))
+		// start rewrites the same file, which is removed when the job finishes
+		done, err := srv.jobs.start(job)
+		if err != nil {
+			logger.Error("resuming pending job", slog.String("error", err.Error()))
+			return
+		}
+		logger.Info("resuming interrupted push",
+			slog.Time("received", job.Received),
+			slog.Int("already sent", job.Sent))
+		err = srv.runJob(&job, logger)
+		srv.recordResult(job, err, logger)
+		done(err)
+		if err != nil {
+			logger.Error("resumed push failed", slog.String("error", err.Error()))
+		}
+	}
+}
+
+// remotePush parses a job from a source other than GitHub.
+func (j pushJob) remotePush() (remotePush, error) {
+	switch j.Source {
+	case sourceGitLab:
+		push, err := parseGitlabPush(j.Payload)
+		if err != nil {
+			return remotePush{}, err
+		}
+		return push.remote(), nil
+	case sourceGitea:
+		push, err := parseGiteaPush(j.Payload)
+		if err != nil {
+			return remotePush{}, err
+		}
+		return push.remote(), nil
+	case sourceGeneric:
+		push, err := parseGenericPush(j.Payload)
+		if err != nil {
+			return remotePush{}, err
+		}
+		return push.remote(), nil
+	}
+	return remotePush{}, fmt.Errorf("job %s has unknown source %q", j.Delivery, j.Source)
+}
+
+// repo is the repo a job pushed to, or "" if the job can't be parsed.
+func (j pushJob) repo() string {
+	if j.Source == sourceGitHub {
+		event, err := j.githubEvent()
+		if err != nil {
+			return ""
+		}
+		return event.GetRepo().GetFullName()
+	}
+	push, err := j.remotePush()
+	if err != nil {
+		return ""
+	}
+	return push.Repo
+}
+
+// runJob runs a saved push through the pipeline for its source, updating
+// the job's progress.
+func (srv Server) runJob(job *pushJob, logger *slog.Logger) error {
+	if job.Source == sourceGitHub {
+		event, err := job.githubEvent()
+		if err != nil {
+			return err
+		}
+		return srv.handlePush(job, event, logger)
+	}
+	push, err := job.remotePush()
+	if err != nil {
+		return err
+	}
+	return srv.handleRemotePush(job, push, logger)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestResumeSkipsSentEmails checks that a push resumed after sending some of
+// its emails only sends the rest, and that progress is saved as it goes.
+func TestResumeSkipsSentEmails(t *testing.T) {
+	jobs, err := newJobTracker(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedCfg, savedStdout := Cfg, mailStdout
+	t.Cleanup(func() {
+		Cfg, mailStdout = savedCfg, savedStdout
+	})
+	Cfg.SmtpPassword = ""
+	var out bytes.Buffer
+	mailStdout = &out
+
+	job := pushJob{Delivery: "resume", Received: time.Now(), Sent: 1}
+	done, err := jobs.start(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := PushHandler{srv: Server{jobs: jobs}, log: slog.Default(), job: &job}
+	emails := [][]byte{[]byte("Subject: one\n"), []byte("Subject: two\n"), []byte("Subject: three\n")}
+	if err := h.deliverEmails(context.Background(), nil, emails); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "Subject: one") {
+		t.Errorf("resumed push re-sent its first email:\n%s", out.String())
+	}
+	if got := len(splitMultimailOutput(out.Bytes())); got != 2 {
+		t.Errorf("sent %d emails, want 2", got)
+	}
+	saved, err := readJobs(jobs.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0].Sent != 3 {
+		t.Errorf("saved jobs %+v, want one with 3 sent", saved)
+	}
+	done(nil)
+}
+
+// TestDrainCancelsPush checks that a push still running at the drain deadline
+// is stopped and left in pending, with its progress, to be resumed.
+func TestDrainCancelsPush(t *testing.T) {
+	jobs, err := newJobTracker(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := pushJob{Delivery: "drain", Received: time.Now(), Sent: 2}
+	done, err := jobs.start(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		ctx, cancel := jobs.pushContext()
+		defer cancel()
+		<-ctx.Done()
+		done(ctx.Err())
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := jobs.drain(ctx); err == nil {
+		t.Error("drain returned nil with a push still running")
+	}
+	if !jobs.interrupted() {
+		t.Error("push context wasn't canceled by drain")
+	}
+	saved, err := readJobs(jobs.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0].Sent != 2 {
+		t.Errorf("pending jobs %+v, want the interrupted push", saved)
+	}
+}
+
+// TestCanceledCloneStops checks that canceling a push (as drain does) stops a
+// clone that's waiting on the server.
+func TestCanceledCloneStops(t *testing.T) {
+	requireGit(t)
+	// a server that accepts connections and never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make(chan net.Conn, 10)
+	t.Cleanup(func() {
+		l.Close()
+		for len(conns) > 0 {
+			(<-conns).Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = gitClone(ctx, "https://"+l.Addr().String()+"/proj.git", filepath.Join(t.TempDir(), "proj.git"), nil, cloneFull)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("clone returned %v, want the context's error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("clone took %v to stop", elapsed)
+	}
+}
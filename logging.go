@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// log configuration and rotation
+
+// rotatingFile is an append-only log file that is rotated once it reaches
+// maxSize bytes, keeping at most maxFiles old logs (path.1 is the newest).
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	// lastFailure is when rotating last failed, so it isn't retried on every
+	// write
+	lastFailure time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = fi.Size()
+	return nil
+}
+
+func (r *rotatingFile) shift() error {
+	if r.maxFiles > 0 {
+		_ = os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxFiles))
+		for i := r.maxFiles - 1; i >= 1; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		return os.Rename(r.path, r.path+".1")
+	}
+	return os.Remove(r.path)
+}
+
+// rotate moves the current log aside and starts a new one. The log is always
+// reopened, so if moving it fails, writes carry on in the same file.
+func (r *rotatingFile) rotate() error {
+	err := r.f.Close()
+	if err == nil {
+		err = r.shift()
+	}
+	if openErr := r.open(); openErr != nil {
+		return errors.Join(err, openErr)
+	}
+	return err
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize &&
+		time.Since(r.lastFailure) > time.Minute {
+		if err := r.rotate(); err != nil {
+			r.lastFailure = time.Now()
+			// the log can't report its own failure
+			fmt.Fprintf(os.Stderr, "rotating log: %v\n", err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// teeWriter writes to every destination even if some fail, unlike
+// io.MultiWriter, which stops at the first error.
+type teeWriter []io.Writer
+
+func (t teeWriter) Write(p []byte) (int, error) {
+	var errs []error
+	for _, w := range t {
+		if _, err := w.Write(p); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return len(p), errors.Join(errs...)
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	return level, err
+}
+
+// setupLogging creates the log handler described by cfg. The returned closer
+// should be closed on exit to flush the log file.
+func setupLogging(cfg AppConfig) (slog.Handler, io.Closer, error) {
+	var outputs []io.Writer
+	var closer io.Closer = io.NopCloser(nil)
+	for _, dest := range strings.Split(cfg.LogOutput, ",") {
+		switch strings.TrimSpace(dest) {
+		case "file":
+			f, err := openRotatingFile(
+				filepath.Join(cfg.PersistPath, "commit-email-bot.log"),
+				cfg.LogMaxSize, cfg.LogMaxFiles)
+			if err != nil {
+				return nil, nil, fmt.Errorf("could not create log file: %w", err)
+			}
+			outputs = append(outputs, f)
+			closer = f
+		case "stderr":
+			outputs = append(outputs, os.Stderr)
+		default:
+			return nil, nil, fmt.Errorf("unknown log output %q (should be file or stderr)", dest)
+		}
+	}
+	w := teeWriter(outputs)
+	opts := &slog.HandlerOptions{Level: cfg.LogLevel}
+	switch cfg.LogFormat {
+	case "json":
+		return slog.NewJSONHandler(w, opts), closer, nil
+	case "text":
+		return slog.NewTextHandler(w, opts), closer, nil
+	}
+	return nil, nil, fmt.Errorf("unknown log format %q (should be json or text)", cfg.LogFormat)
+}
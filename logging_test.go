@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotateFailureKeepsLogging(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bot.log")
+	r, err := openRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// a non-empty directory in the way makes renaming the log fail
+	if err := os.MkdirAll(filepath.Join(path+".1", "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first line\n", "second line\n", "third line\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatalf("write after failed rotation: %v", err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "third line") {
+		t.Errorf("log is missing writes after the failed rotation:\n%s", data)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestTeeWriterWritesEverywhere(t *testing.T) {
+	var buf bytes.Buffer
+	w := teeWriter{failingWriter{}, &buf}
+	if _, err := w.Write([]byte("hello\n")); err == nil {
+		t.Error("error from the first writer was dropped")
+	}
+	if buf.String() != "hello\n" {
+		t.Errorf("second writer got %q", buf.String())
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// sending emails from the bot
+//
+// git_multimail only generates the commit emails (with --stdout); they are
+// sent from here like the bot's own emails.
+
+const (
+	smtpUser = "postmaster@mail.commit-emails.xyz"
+
+	notificationsAddress = "notifications@commit-emails.xyz"
+)
+
+// the SMTP server, which tests replace with a fake
+var (
+	smtpServer    = "smtp.mailgun.org:465"
+	smtpTLSConfig = &tls.Config{}
+)
+
+// mailStdout is where emails go when there is no SMTP password configured.
+var mailStdout io.Writer = os.Stdout
+
+// composeMail formats a plain-text email from the bot.
+func composeMail(to []string, subject string, body string) []byte {
+	return composeRepoMail(to, "", subject, body)
+}
+
+// composeRepoMail formats an email about a repo, whose signature ends with
+// the repo's name like git_multimail's emails, so a filter catches both.
+func composeRepoMail(to []string, repo string, subject string, body string) []byte {
+	buf := &bytes.Buffer{}
+	msgId := make([]byte, 16)
+	_, _ = rand.Read(msgId)
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "From: commit-email-bot <%s>\r\n", notificationsAddress)
+	fmt.Fprintf(buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(buf, "Message-ID: <%s@commit-emails.xyz>\r\n", hex.EncodeToString(msgId))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	buf.WriteString("Auto-Submitted: auto-generated\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	buf.WriteString("\r\n-- \r\ncommit-email-bot jD27HVpTX3tELRBjcpGsK6io7")
+	if repo != "" {
+		buf.WriteString(" " + repo)
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// headerAddresses formats addresses for an email's To header, with their
+// names.
+func headerAddresses(addrs []*mail.Address) []string {
+	var to []string
+	for _, addr := range addrs {
+		to = append(to, addr.String())
+	}
+	return to
+}
+
+// envelopeAddresses is addresses as the SMTP envelope takes them, without
+// names or angle brackets.
+func envelopeAddresses(addrs []*mail.Address) []string {
+	var to []string
+	for _, addr := range addrs {
+		to = append(to, addr.Address)
+	}
+	return to
+}
+
+// sendMail delivers msg over SMTP to the given bare addresses (see
+// envelopeAddresses), or prints it if emails are going to stdout.
+func sendMail(to []string, msg []byte) error {
+	if Cfg.SmtpPassword == "" {
+		_, err := fmt.Fprintf(mailStdout, "%s\n", msg)
+		return err
+	}
+	host := strings.Split(smtpServer, ":")[0]
+	tlsConfig := smtpTLSConfig.Clone()
+	tlsConfig.ServerName = host
+	conn, err := tls.Dial("tcp", smtpServer, tlsConfig)
+	if err != nil {
+		return fmt.Errorf("smtp connect: %w", err)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return fmt.Errorf("smtp client: %w", err)
+	}
+	defer c.Close()
+	if err := c.Auth(smtp.PlainAuth("", smtpUser, Cfg.SmtpPassword, host)); err != nil {
+		return fmt.Errorf("smtp auth: %w", err)
+	}
+	if err := c.Mail(notificationsAddress); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return fmt.Errorf("smtp rcpt %s: %w", addr, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// parseMailingList splits the "to" field of commit-emails.toml into
+// individual addresses.
+func parseMailingList(list string) ([]*mail.Address, error) {
+	addrs, err := mail.ParseAddressList(list)
+	if err != nil {
+		return nil, fmt.Errorf("invalid to addresses %q: %w", list, err)
+	}
+	return addrs, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tchajed/commit-emails-bot/stats"
+)
+
+// fakeSMTP is an SMTP server that accepts everything and records the
+// commands it gets.
+type fakeSMTP struct {
+	addr string
+
+	mu       sync.Mutex
+	commands []string
+}
+
+func newFakeSMTP(t *testing.T) (*fakeSMTP, *tls.Config) {
+	t.Helper()
+	// borrow httptest's certificate, which is valid for 127.0.0.1
+	certServer := httptest.NewTLSServer(nil)
+	certServer.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(certServer.Certificate())
+	l, err := tls.Listen("tcp", "127.0.0.1:0", certServer.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	f := &fakeSMTP{addr: l.Addr().String()}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f, &tls.Config{RootCAs: roots}
+}
+
+func (f *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(s string) { _, _ = conn.Write([]byte(s + "\r\n")) }
+	reply("220 fake ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		f.mu.Lock()
+		f.commands = append(f.commands, line)
+		f.mu.Unlock()
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO":
+			reply("250-fake")
+			reply("250 AUTH PLAIN")
+		case "AUTH":
+			reply("235 ok")
+		case "RCPT":
+			// like a real server, reject anything that isn't <address>
+			addr := strings.TrimPrefix(line, "RCPT TO:")
+			if !strings.HasPrefix(addr, "<") || strings.Count(addr, "<") != 1 || !strings.HasSuffix(addr, ">") {
+				reply("501 bad address")
+				continue
+			}
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil || line == ".\r\n" {
+					break
+				}
+			}
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (f *fakeSMTP) rcpts() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var rcpts []string
+	for _, c := range f.commands {
+		if strings.HasPrefix(c, "RCPT") {
+			rcpts = append(rcpts, c)
+		}
+	}
+	return rcpts
+}
+
+// useFakeSMTP sends the test's emails to a fake SMTP server.
+func useFakeSMTP(t *testing.T) *fakeSMTP {
+	t.Helper()
+	server, tlsConfig := newFakeSMTP(t)
+	savedCfg, savedServer, savedTLS := Cfg, smtpServer, smtpTLSConfig
+	t.Cleanup(func() {
+		Cfg, smtpServer, smtpTLSConfig = savedCfg, savedServer, savedTLS
+	})
+	Cfg.SmtpPassword = "password"
+	smtpServer, smtpTLSConfig = server.addr, tlsConfig
+	return server
+}
+
+func TestSendMailEnvelope(t *testing.T) {
+	server := useFakeSMTP(t)
+
+	addrs, err := parseMailingList(`foo@example.com, "Bar Baz" <bar@example.net>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := composeMail(headerAddresses(addrs), "Test", "body\n")
+	if err := sendMail(envelopeAddresses(addrs), msg); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"RCPT TO:<foo@example.com>", "RCPT TO:<bar@example.net>"}
+	if got := server.rcpts(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("RCPT commands are %q, want %q", got, want)
+	}
+	if !strings.Contains(string(msg), "To: <foo@example.com>, \"Bar Baz\" <bar@example.net>\r\n") {
+		t.Errorf("To header lost the names:\n%s", msg)
+	}
+}
+
+// TestFailureEmailEnvelope checks that a named admin address gets the failure
+// email at its bare address.
+func TestFailureEmailEnvelope(t *testing.T) {
+	server := useFakeSMTP(t)
+	db, err := stats.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := newVerifyToken()
+	if err := db.AddRecipient("alice/proj", "admin@example.com", token); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := db.VerifyRecipient(token); err != nil {
+		t.Fatal(err)
+	}
+	h := PushHandler{srv: Server{db: db}, repo: "alice/proj", log: slog.Default()}
+	push := pushInfo{Before: zeroSha, After: zeroSha, Ref: "refs/heads/main"}
+	if !h.emailFailure(`"Alice Admin" <admin@example.com>`, push, errors.New("failed")) {
+		t.Fatal("failure email wasn't sent")
+	}
+	want := []string{"RCPT TO:<admin@example.com>"}
+	if got := server.rcpts(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("RCPT commands are %q, want %q", got, want)
+	}
+}
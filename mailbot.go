@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"crypto/tls"
@@ -12,7 +11,9 @@ import (
 	"fmt"
 	"log"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -24,7 +25,6 @@ import (
 
 	"github.com/tchajed/commit-emails-bot/stats"
 
-	"github.com/bradleyfalzon/ghinstallation/v2"
 	"github.com/google/go-github/v62/github"
 	"github.com/gregjones/httpcache"
 	"golang.org/x/crypto/acme/autocert"
@@ -41,13 +41,55 @@ type AppConfig struct {
 	AppId         int64
 	AppPrivateKey []byte
 
-	DenyAccounts map[string]bool
+	LogLevel    slog.Level
+	LogFormat   string // json or text
+	LogOutput   string // comma-separated list of file and stderr
+	LogMaxSize  int64  // bytes before the log file is rotated (0 to disable)
+	LogMaxFiles int    // number of rotated log files to keep
+
+	// AllowList restricts the bot to accounts in allow-accounts.txt
+	AllowList bool
+	Access    *AccessPolicy
+
+	// GitlabSecret is the X-Gitlab-Token for GitLab webhooks (GitLab
+	// webhooks are disabled if it's empty), and GitlabToken is an access
+	// token for cloning non-public GitLab projects. GitlabURL is the GitLab
+	// server, which pushes must come from and the only place the token is
+	// sent (any server is allowed if it's empty, without the token).
+	GitlabSecret []byte
+	GitlabToken  string
+	GitlabURL    string
+	// the same for Gitea (and Forgejo)
+	GiteaSecret []byte
+	GiteaToken  string
+	GiteaURL    string
+	// GenericSecret signs pushes to /webhook/generic
+	GenericSecret []byte
+
+	// GitHubURL is the address of a GitHub Enterprise Server, or empty for
+	// github.com
+	GitHubURL string
+
+	// CloneMode is the default for how repos are cloned (full, partial, or
+	// shallow)
+	CloneMode string
+
+	// DrainTimeout is how long shutdown waits for in-flight pushes
+	DrainTimeout time.Duration
+
+	// AdminToken authorizes the /admin endpoints (which are disabled if it's
+	// empty)
+	AdminToken string
+
+	// RecordDeliveries is how many GitHub deliveries to save for replaying
+	// with test-push (0 to disable)
+	RecordDeliveries int
 }
 
 var Cfg AppConfig
 
-func (cfg AppConfig) Denied(account string) bool {
-	return cfg.DenyAccounts[account]
+func (cfg AppConfig) Denied(account string, repo string, installation int64) bool {
+	return cfg.Access.Denied(account, repo, installation)
 }
 
 func init() {
@@ -74,12 +116,36 @@ func init() {
 	Cfg.Port = "https"
 	Cfg.WebhookSecret = []byte(getEncryptedEnv("WEBHOOK_SECRET"))
 	Cfg.SmtpPassword = getEncryptedEnv("MAIL_SMTP_PASSWORD")
+	Cfg.GitlabSecret = []byte(getEncryptedEnv("GITLAB_WEBHOOK_SECRET"))
+	Cfg.GitlabToken = getEncryptedEnv("GITLAB_TOKEN")
+	Cfg.GitlabURL = os.Getenv("GITLAB_URL")
+	Cfg.GiteaSecret = []byte(getEncryptedEnv("GITEA_WEBHOOK_SECRET"))
+	Cfg.GiteaToken = getEncryptedEnv("GITEA_TOKEN")
+	Cfg.GiteaURL = os.Getenv("GITEA_URL")
+	Cfg.GenericSecret = []byte(getEncryptedEnv("GENERIC_WEBHOOK_SECRET"))
+	Cfg.AdminToken = getEncryptedEnv("ADMIN_TOKEN")
+	var err error
 	emailStdout := os.Getenv("EMAIL_STDOUT")
 	if emailStdout == "true" || emailStdout == "1" {
 		Cfg.EmailStdout = true
 	}
+	Cfg.GitHubURL = os.Getenv("GITHUB_URL")
+	Cfg.CloneMode = os.Getenv("GIT_CLONE_MODE")
+	if Cfg.CloneMode == "" {
+		Cfg.CloneMode = cloneFull
+	}
+	Cfg.DrainTimeout = 60 * time.Second
+	if drain := os.Getenv("SHUTDOWN_DRAIN_TIMEOUT"); drain != "" {
+		Cfg.DrainTimeout, err = time.ParseDuration(drain)
+		if err != nil {
+			log.Fatalf("SHUTDOWN_DRAIN_TIMEOUT is not a duration, got %s", drain)
+		}
+	}
+	allowList := os.Getenv("ALLOW_LIST")
+	if allowList == "true" || allowList == "1" {
+		Cfg.AllowList = true
+	}
 
-	var err error
 	appIdStr := getEncryptedEnv("GITHUB_APP_ID")
 	if appIdStr != "" {
 		Cfg.AppId, err = strconv.ParseInt(appIdStr, 10, 64)
@@ -96,19 +162,127 @@ func init() {
 			log.Fatal("private key has invalid base64")
 		}
 	}
+
+	Cfg.LogLevel = slog.LevelInfo
+	if level := os.Getenv("LOG_LEVEL"); level != "" {
+		Cfg.LogLevel, err = parseLogLevel(level)
+		if err != nil {
+			log.Fatalf("LOG_LEVEL is invalid: %v", err)
+		}
+	}
+	Cfg.LogFormat = os.Getenv("LOG_FORMAT")
+	if Cfg.LogFormat == "" {
+		Cfg.LogFormat = "json"
+	}
+	Cfg.LogOutput = os.Getenv("LOG_OUTPUT")
+	if Cfg.LogOutput == "" {
+		Cfg.LogOutput = "file,stderr"
+	}
+	Cfg.LogMaxSize = 50 << 20
+	if sizeStr := os.Getenv("LOG_MAX_SIZE_MB"); sizeStr != "" {
+		sizeMB, err := strconv.ParseInt(sizeStr, 10, 64)
+		if err != nil {
+			log.Fatalf("LOG_MAX_SIZE_MB is not a number, got %s", sizeStr)
+		}
+		Cfg.LogMaxSize = sizeMB << 20
+	}
+	if recordStr := os.Getenv("RECORD_DELIVERIES"); recordStr != "" {
+		Cfg.RecordDeliveries, err = strconv.Atoi(recordStr)
+		if err != nil {
+			log.Fatalf("RECORD_DELIVERIES is not a number, got %s", recordStr)
+		}
+	}
+	Cfg.LogMaxFiles = 5
+	if filesStr := os.Getenv("LOG_MAX_FILES"); filesStr != "" {
+		Cfg.LogMaxFiles, err = strconv.Atoi(filesStr)
+		if err != nil {
+			log.Fatalf("LOG_MAX_FILES is not a number, got %s", filesStr)
+		}
+	}
 }
 
 func (c AppConfig) Insecure() bool {
 	return c.Hostname == "localhost"
 }
 
+// GitHubHost is the host name repos are cloned from.
+func (c AppConfig) GitHubHost() string {
+	if c.GitHubURL == "" {
+		return "github.com"
+	}
+	u, err := url.Parse(c.GitHubURL)
+	if err != nil || u.Host == "" {
+		return c.GitHubURL
+	}
+	return u.Host
+}
+
+// APIBaseURL is the root of the GitHub REST API, which GitHub Enterprise
+// Server serves under /api/v3.
+func (c AppConfig) APIBaseURL() string {
+	if c.GitHubURL == "" {
+		return "https://api.github.com/"
+	}
+	return strings.TrimSuffix(c.GitHubURL, "/") + "/api/v3/"
+}
+
+// BaseURL is the externally-visible address of this server, for links in
+// emails.
+func (c AppConfig) BaseURL() string {
+	if c.Insecure() {
+		port, err := net.LookupPort("tcp", c.Port)
+		if err != nil {
+			return fmt.Sprintf("http://%s", c.Hostname)
+		}
+		return fmt.Sprintf("http://%s:%d", c.Hostname, port)
+	}
+	return fmt.Sprintf("https://%s", c.Hostname)
+}
+
 //go:embed index.html
 var indexHTML []byte
 
 // Server tracks state for the running in-memory server
 type Server struct {
-	transport http.RoundTripper
-	db        stats.Database
+	transport     http.RoundTripper
+	installations *installationTransports
+	db            stats.Database
+	jobs          *jobTracker
+	locks         *repoLocks
+	recorder      *deliveryRecorder
+	failed        *failedJobs
+	mailCheck     *mailCheck
+}
+
+// newServer opens the server's state in the persist directory.
+func newServer() (Server, error) {
+	ct := httpcache.NewMemoryCacheTransport()
+	db, err := stats.New(Cfg.PersistPath)
+	if err != nil {
+		return Server{}, fmt.Errorf("could not open database: %w", err)
+	}
+	jobs, err := newJobTracker(Cfg.PersistPath)
+	if err != nil {
+		return Server{}, fmt.Errorf("could not create pending job directory: %w", err)
+	}
+	failed, err := newFailedJobs(Cfg.PersistPath)
+	if err != nil {
+		return Server{}, fmt.Errorf("could not create failed job directory: %w", err)
+	}
+	recorder, err := newDeliveryRecorder(Cfg.PersistPath, Cfg.RecordDeliveries)
+	if err != nil {
+		return Server{}, fmt.Errorf("could not create deliveries directory: %w", err)
+	}
+	return Server{
+		transport:     ct,
+		installations: newInstallationTransports(ct),
+		db:            db,
+		jobs:          jobs,
+		locks:         newRepoLocks(),
+		recorder:      recorder,
+		failed:        failed,
+		mailCheck:     newMailCheck(),
+	}, nil
 }
 
 // PushHandler tracks state for a single push handler
@@ -116,49 +290,95 @@ type PushHandler struct {
 	srv          Server
 	installation int64
 	repo         string
+	log          *slog.Logger
+	// job records which emails were sent (nil if the push isn't tracked)
+	job *pushJob
 }
 
-func openDenyAccounts(path string) map[string]bool {
-	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
+func openAccessPolicy(persistPath string, allowList bool) *AccessPolicy {
+	deny, err := loadAccessList(filepath.Join(persistPath, "deny-accounts.txt"))
 	if err != nil {
 		log.Fatalf("could not open deny file: %v", err)
 	}
-	deny := make(map[string]bool)
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		deny[scanner.Text()] = true
+	policy := &AccessPolicy{Deny: deny}
+	if allowList {
+		policy.Allow, err = loadAccessList(filepath.Join(persistPath, "allow-accounts.txt"))
+		if err != nil {
+			log.Fatalf("could not open allow file: %v", err)
+		}
 	}
-	defer f.Close()
-	return deny
+	return policy
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "credential-helper":
+			credentialHelperMain(os.Args[2:])
+			return
+		case "post-receive":
+			postReceiveMain(os.Args[2:])
+			return
+		case "render":
+			renderMain(os.Args[2:])
+			return
+		case "fake-github":
+			fakeGitHubMain(os.Args[2:])
+			return
+		case "failed":
+			failedMain(os.Args[2:])
+			return
+		}
+	}
+
 	flag.StringVar(&Cfg.Hostname, "hostname", Cfg.Hostname, "tls hostname (use localhost to disable https)")
 	flag.StringVar(&Cfg.PersistPath, "persist", Cfg.PersistPath, "directory for persistent data")
 	flag.StringVar(&Cfg.Port, "port", Cfg.Port, "port to listen on")
+	flag.TextVar(&Cfg.LogLevel, "log-level", Cfg.LogLevel, "minimum log level (debug, info, warn, error)")
+	flag.StringVar(&Cfg.LogFormat, "log-format", Cfg.LogFormat, "log format (json or text)")
+	flag.StringVar(&Cfg.LogOutput, "log-output", Cfg.LogOutput, "comma-separated log destinations (file, stderr)")
+	flag.StringVar(&Cfg.GitHubURL, "github-url", Cfg.GitHubURL, "GitHub Enterprise Server URL (empty for github.com)")
+	flag.StringVar(&Cfg.CloneMode, "clone-mode", Cfg.CloneMode, "how to clone repos (full, partial, or shallow)")
+	flag.DurationVar(&Cfg.DrainTimeout, "drain-timeout", Cfg.DrainTimeout, "how long to wait for in-flight pushes on shutdown")
+	flag.BoolVar(&Cfg.AllowList, "allow-list", Cfg.AllowList, "only serve accounts in allow-accounts.txt")
+	flag.IntVar(&Cfg.RecordDeliveries, "record-deliveries", Cfg.RecordDeliveries, "number of GitHub deliveries to save in persist/deliveries (0 to disable)")
 	flag.Parse()
 
 	if Cfg.EmailStdout {
 		Cfg.SmtpPassword = ""
 	}
+	if Cfg.GitHubURL != "" {
+		u, err := url.Parse(Cfg.GitHubURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			log.Fatalf("invalid GitHub URL %s (should be like https://github.example.com)", Cfg.GitHubURL)
+		}
+	}
+	if err := checkServerConfig("GITLAB", Cfg.GitlabURL, Cfg.GitlabToken); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkServerConfig("GITEA", Cfg.GiteaURL, Cfg.GiteaToken); err != nil {
+		log.Fatal(err)
+	}
+	if !validCloneMode(Cfg.CloneMode) {
+		log.Fatalf("invalid clone mode %s (should be full, partial, or shallow)", Cfg.CloneMode)
+	}
 
 	if err := os.MkdirAll(Cfg.PersistPath, 0770); err != nil {
 		log.Fatal(err)
 	}
 
-	Cfg.DenyAccounts = openDenyAccounts(filepath.Join(Cfg.PersistPath, "deny-accounts.txt"))
+	Cfg.Access = openAccessPolicy(Cfg.PersistPath, Cfg.AllowList)
 
-	logFile, err := os.OpenFile(
-		filepath.Join(Cfg.PersistPath, "commit-email-bot.log"),
-		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+	handler, logFile, err := setupLogging(Cfg)
 	if err != nil {
-		log.Fatalf("could not create log file: %v", err)
+		log.Fatal(err)
 	}
 	defer logFile.Close()
-	handler := slog.NewJSONHandler(logFile, nil)
 	logger := slog.New(handler)
 	slog.SetDefault(logger)
 
+	Cfg.Access.watch(30 * time.Second)
+
 	tlsKeysDir := filepath.Join(Cfg.PersistPath, "tls_keys")
 	certManager := autocert.Manager{
 		Cache:      autocert.DirCache(tlsKeysDir),
@@ -179,14 +399,9 @@ func main() {
 		}()
 	}
 
-	ct := httpcache.NewMemoryCacheTransport()
-	db, err := stats.New(Cfg.PersistPath)
+	srv, err := newServer()
 	if err != nil {
-		log.Fatalf("could not open database: %v", err)
-	}
-	srv := Server{
-		transport: ct,
-		db:        db,
+		log.Fatal(err)
 	}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
@@ -196,6 +411,30 @@ func main() {
 	mux.HandleFunc("/webhook", func(w http.ResponseWriter, req *http.Request) {
 		srv.githubEventHandler(w, req)
 	})
+	mux.HandleFunc("/webhook/gitlab", func(w http.ResponseWriter, req *http.Request) {
+		srv.gitlabEventHandler(w, req)
+	})
+	mux.HandleFunc("/webhook/gitea", func(w http.ResponseWriter, req *http.Request) {
+		srv.giteaEventHandler(w, req)
+	})
+	mux.HandleFunc("/webhook/generic", func(w http.ResponseWriter, req *http.Request) {
+		srv.genericEventHandler(w, req)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		srv.healthzHandler(w, req)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		srv.readyzHandler(w, req)
+	})
+	mux.HandleFunc("/verify", func(w http.ResponseWriter, req *http.Request) {
+		srv.verifyHandler(w, req)
+	})
+	mux.HandleFunc("/admin/failed", func(w http.ResponseWriter, req *http.Request) {
+		srv.failedHandler(w, req)
+	})
+	mux.HandleFunc("/admin/installation-errors", func(w http.ResponseWriter, req *http.Request) {
+		srv.installationErrorsHandler(w, req)
+	})
 
 	httpServer := &http.Server{
 		Addr:    fmt.Sprintf(":%s", Cfg.Port),
@@ -220,13 +459,22 @@ func main() {
 		<-sigChan
 		fmt.Println("Shutting down...")
 		slog.Info("shutting down")
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), Cfg.DrainTimeout)
 		defer cancel()
 
+		// stop accepting pushes before waiting on the HTTP server, so that
+		// requests that arrive during shutdown are rejected rather than
+		// started
+		drained := make(chan error, 1)
+		go func() { drained <- srv.jobs.drain(ctx) }()
 		err := httpServer.Shutdown(ctx)
 		if err != nil {
 			slog.Error("http server shutdown", slog.String("error", err.Error()))
 		}
+		if err := <-drained; err != nil {
+			slog.Warn("shutdown with pushes still in progress; they will resume on restart",
+				slog.String("error", err.Error()))
+		}
 		close(shutdownDone)
 	}()
 
@@ -235,6 +483,7 @@ func main() {
 	}
 	fmt.Printf("host %s listening on :%s\n", Cfg.Hostname, Cfg.Port)
 	slog.Info("starting server")
+	go srv.resumePending()
 	if Cfg.Insecure() {
 		err = httpServer.ListenAndServe()
 	} else {
@@ -253,9 +502,17 @@ func (srv Server) githubEventHandler(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, "could not validate payload: "+err.Error(), http.StatusBadRequest)
 		return
 	}
+	delivery := jobID(github.DeliveryID(req))
+	logger := slog.With(slog.String("delivery", delivery))
+	// only deliveries with a valid signature are recorded, so the disk can't
+	// be filled by anyone who finds the endpoint
+	if err := srv.recorder.record(req, delivery, payload); err != nil {
+		logger.Warn("could not record delivery", slog.String("error", err.Error()))
+	}
 	event, err := github.ParseWebHook(github.WebHookType(req), payload)
 	if err != nil {
 		http.Error(w, "could not parse webhook: "+err.Error(), http.StatusBadRequest)
+		return
 	}
 	switch event := event.(type) {
 	case *github.PingEvent:
@@ -266,43 +523,43 @@ func (srv Server) githubEventHandler(w http.ResponseWriter, req *http.Request) {
 		if account == "" {
 			account = event.GetRepo().GetOrganization()
 		}
-		if Cfg.Denied(account) {
-			slog.Info("denied push", slog.String("account", account))
+		repo := event.GetRepo().GetFullName()
+		if Cfg.Denied(account, repo, event.GetInstallation().GetID()) {
+			logger.Info("denied push",
+				slog.String("account", account),
+				slog.String("repo", repo))
 			http.Error(w, "account denied", http.StatusForbidden)
 			return
 		}
-		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
-		defer cancel()
-		repo := event.GetRepo().GetFullName()
-		err := PushHandler{
-			srv:          srv,
-			installation: event.GetInstallation().GetID(),
-			repo:         repo,
-		}.githubPushHandler(ctx, event)
+		job := pushJob{
+			Delivery: delivery,
+			Event:    github.WebHookType(req),
+			Payload:  payload,
+			Received: time.Now(),
+		}
+		done, err := srv.jobs.start(job)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		err = srv.handlePush(&job, event, logger)
+		srv.recordResult(job, err, logger)
+		done(err)
 		if err != nil {
-			err = fmt.Errorf("push handler failed: %s", err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
-			slog.Error("push handler",
-				slog.String("error", err.Error()),
-				slog.String("repo", repo))
 			return
 		}
-		srv.db.AddPush(event)
 		_, _ = w.Write([]byte("OK"))
-		before := (*event.Before)[:8]
-		after := (*event.After)[:8]
-		slog.Info("push success",
-			slog.String("repo", repo),
-			slog.String("ref change", fmt.Sprintf("%s: %s -> %s", event.GetRef(), before, after)),
-		)
 	case *github.InstallationEvent:
-		slog.Info("installation",
+		logger.Info("installation",
+			slog.Int64("installation", event.GetInstallation().GetID()),
 			slog.String("action", event.GetAction()),
 			slog.String("account", event.GetInstallation().GetAccount().GetLogin()),
 		)
 		srv.db.AddInstallation(event)
 	case *github.InstallationRepositoriesEvent:
-		slog.Info("installation",
+		logger.Info("installation",
+			slog.Int64("installation", event.GetInstallation().GetID()),
 			slog.String("action", event.GetAction()),
 			slog.String("account", event.GetInstallation().GetAccount().GetLogin()),
 		)
@@ -311,66 +568,253 @@ func (srv Server) githubEventHandler(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// handlePush runs a push through the pipeline, whether it came from a webhook
+// or was resumed from disk.
+func (srv Server) handlePush(job *pushJob, event *github.PushEvent, logger *slog.Logger) error {
+	repo := event.GetRepo().GetFullName()
+	installation := event.GetInstallation().GetID()
+	logger = logger.With(
+		slog.String("repo", repo),
+		slog.Int64("installation", installation))
+	ctx, cancel := srv.jobs.pushContext()
+	defer cancel()
+	err := PushHandler{
+		srv:          srv,
+		installation: installation,
+		repo:         repo,
+		log:          logger,
+		job:          job,
+	}.githubPushHandler(ctx, event)
+	if err != nil {
+		err = fmt.Errorf("push handler failed: %s", err)
+		logger.Error("push handler", slog.String("error", err.Error()))
+		return err
+	}
+	srv.db.AddPush(event)
+	before := (*event.Before)[:8]
+	after := (*event.After)[:8]
+	logger.Info("push success",
+		slog.String("ref change", fmt.Sprintf("%s: %s -> %s", event.GetRef(), before, after)),
+	)
+	return nil
+}
+
 func (h PushHandler) githubPushHandler(ctx context.Context, ev *github.PushEvent) error {
-	itr, err := ghinstallation.New(h.srv.transport, Cfg.AppId, *ev.Installation.ID, Cfg.AppPrivateKey)
+	itr, err := h.srv.installations.get(h.installation)
+	if err != nil {
+		return err
+	}
+	client, err := newGitHubClient(itr)
+	if err != nil {
+		return err
+	}
+	// hold the repo lock through sending, so that emails for concurrent pushes
+	// to the same repo go out in order
+	unlock, err := h.srv.locks.lock(ctx, repoGitDir(Cfg.PersistPath, ev.Repo))
 	if err != nil {
 		return err
 	}
-	client := github.NewClient(&http.Client{Transport: itr})
-	gitDir, err := SyncRepo(ctx, client, ev.Repo)
+	defer unlock()
+	gitDir, auth, err := h.SyncRepo(ctx, client, ev)
 	if err != nil {
 		if _, ok := err.(MissingConfigError); ok {
-			slog.Info("push to unconfigured repo", slog.String("repo", h.repo))
+			h.log.Info("push to unconfigured repo")
 			return nil
 		}
+		h.notifyFailure(ctx, repoGitDir(Cfg.PersistPath, ev.Repo), client, ev, githubPushInfo(ev), err)
 		return err
 	}
-
-	args := []string{}
-	if Cfg.SmtpPassword == "" {
-		args = append(args, "--stdout")
-	}
-	config, err := getConfig(gitDir)
+	push := githubPushInfo(ev)
+	sent, err := h.sendEmails(ctx, gitDir, auth, push)
+	h.reportResult(ctx, gitDir, client, ev, sent, err)
 	if err != nil {
-		return fmt.Errorf("could not get config for %s: %s", h.repo, err)
+		h.notifyFailure(ctx, gitDir, client, ev, push, err)
+		return err
+	}
+	h.srv.db.ClearFailureNotices(h.repo)
+	return nil
+}
+
+// pushInfo is what the email pipeline needs to know about a push, whichever
+// forge it came from.
+type pushInfo struct {
+	Before string
+	After  string
+	Ref    string
+	// CommitterName is used as the name in the From address
+	CommitterName string
+	// CommitBrowseURL is a git_multimail format string for a link to a commit
+	CommitBrowseURL string
+}
+
+func githubPushInfo(ev *github.PushEvent) pushInfo {
+	return pushInfo{
+		Before:          ev.GetBefore(),
+		After:           ev.GetAfter(),
+		Ref:             ev.GetRef(),
+		CommitterName:   ev.GetHeadCommit().GetCommitter().GetName(),
+		CommitBrowseURL: ev.GetRepo().GetHTMLURL() + "/commit/%(id)s",
 	}
-	args = append(args, "-c", fmt.Sprintf("multimailhook.mailingList=%s", config.MailingList))
+}
+
+// multimailCommand prepares git_multimail to generate the emails for push in
+// gitDir. The emails are written to the command's stdout, and the bot sends
+// them itself.
+func multimailCommand(ctx context.Context, gitDir string, auth *gitAuth, config CommitEmailConfig, recipients []string, push pushInfo) *exec.Cmd {
+	args := []string{"--stdout"}
+	args = append(args, "-c", fmt.Sprintf("multimailhook.mailingList=%s", strings.Join(recipients, ", ")))
 	if config.Email.Format != "" {
 		args = append(args, "-c", fmt.Sprintf("multimailhook.commitEmailFormat=%s", config.Email.Format))
 	}
-	fromName := ev.GetHeadCommit().GetCommitter().GetName()
-	fromAddress := "notifications@commit-emails.xyz"
+	fromName := push.CommitterName
+	fromAddress := notificationsAddress
 	if fromName != "" {
 		fromAddress = fmt.Sprintf("%s <%s>", fromName, fromAddress)
 	}
 	args = append(args, "-c", fmt.Sprintf("multimailhook.from=%s", fromAddress))
-	args = append(args, "-c", fmt.Sprintf("multimailhook.commitBrowseURL=%s/commit/%%(id)s", ev.GetRepo().GetHTMLURL()))
-	cmd := exec.Command("./git_multimail_wrapper.py", args...)
-	commitLine := fmt.Sprintf("%s %s %s", *ev.Before, *ev.After, *ev.Ref)
-	stdin := bytes.NewReader([]byte(commitLine))
-	cmd.Stdin = stdin
-	stderrBuf := &bytes.Buffer{}
-	cmd.Stderr = stderrBuf
+	if push.CommitBrowseURL != "" {
+		args = append(args, "-c", fmt.Sprintf("multimailhook.commitBrowseURL=%s", push.CommitBrowseURL))
+	}
+	if _, ok := branchChange(push); ok {
+		// the ref change email is replaced by the bot's, so it mustn't be
+		// combined with a commit's email
+		args = append(args, "-c", "multimailhook.combineWhenSingleCommit=false")
+	}
+	cmd := exec.CommandContext(ctx, "./git_multimail_wrapper.py", args...)
+	cmd.Stdin = strings.NewReader(push.refChange())
 	cmd.Env = os.Environ()
 	cmd.Env = append(cmd.Env, "GIT_DIR="+gitDir)
+	// a partial clone fetches file contents on demand, which needs credentials
+	cmd.Env = append(cmd.Env, "GIT_TERMINAL_PROMPT=0")
+	cmd.Env = append(cmd.Env, auth.env()...)
+	if note := forcePushNote(gitDir, auth, push); note != "" {
+		cmd.Env = append(cmd.Env, forcePushEnv+"="+note)
+	}
 	// constants that configure git_multimail
 	cmd.Env = append(cmd.Env, "GIT_CONFIG_GLOBAL="+"git-multimail.config")
-	// Provide the password via an environment variable - it cannot be in the
-	// config file since that's public, and we don't want it to be in the command
-	// line with -c since other processes can read that.
-	//
-	// Single quotes are necessary for git to parse this correctly.
-	cmd.Env = append(cmd.Env, "GIT_CONFIG_PARAMETERS="+fmt.Sprintf("'multimailhook.smtpPass=%s'", Cfg.SmtpPassword))
-	output, err := cmd.Output()
-	if err == nil {
-		return nil
+	return cmd
+}
+
+// multimailError is a failed git_multimail run. Only the exit status is in
+// the message, which is reported to the repo's admins.
+type multimailError struct {
+	state  string
+	stdout string
+	stderr string
+}
+
+func (e multimailError) Error() string {
+	return fmt.Sprintf("git_multimail_wrapper.py failed: %s", e.state)
+}
+
+// generateEmails produces the emails for push in gitDir, in the order they
+// should be sent.
+func generateEmails(ctx context.Context, gitDir string, auth *gitAuth, config CommitEmailConfig, recipients []string, push pushInfo) ([][]byte, error) {
+	var emails [][]byte
+	_, branch := branchChange(push)
+	if branch && config.branchEmailsEnabled(push) {
+		msg, err := branchMail(gitDir, recipients, repoShortName(gitDir), push)
+		if err != nil {
+			return nil, err
+		}
+		emails = append(emails, msg)
+	}
+	if branch && push.After == zeroSha {
+		// a deleted branch has nothing but the ref change to announce
+		return emails, nil
 	}
+	cmd := multimailCommand(ctx, gitDir, auth, config, recipients, push)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	output, err := cmd.Output()
 	if ee, ok := err.(*exec.ExitError); ok {
-		slog.Error("git_multimail_wrapper.py failed",
-			slog.String("push", commitLine),
-			slog.String("stdout", string(output)),
-			slog.String("stderr", stderrBuf.String()))
-		return fmt.Errorf("git_multimail_wrapper.py  failed: %s", ee.ProcessState.String())
+		return nil, multimailError{
+			state:  ee.ProcessState.String(),
+			stdout: string(output),
+			stderr: stderr.String(),
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range splitMultimailOutput(output) {
+		if branch && isRefChangeEmail(msg) {
+			continue
+		}
+		emails = append(emails, msg)
+	}
+	return emails, nil
+}
+
+// deliverEmail sends one of a push's emails, or prints it (in git_multimail's
+// --stdout format) if emails are going to stdout.
+func deliverEmail(to []string, msg []byte) error {
+	if Cfg.SmtpPassword == "" {
+		_, err := fmt.Fprintf(mailStdout, "%s\n%s%s\n", multimailSeparator, msg, multimailSeparator)
+		return err
+	}
+	return sendMail(to, msg)
+}
+
+// deliverEmails sends a push's emails in order. Each email is recorded in the
+// push's job as it goes out, and emails that an earlier attempt at the push
+// already sent are skipped.
+func (h PushHandler) deliverEmails(ctx context.Context, to []string, emails [][]byte) error {
+	start := 0
+	if h.job != nil && h.job.Sent > 0 {
+		start = min(h.job.Sent, len(emails))
+		h.log.Info("skipping emails already sent", slog.Int("sent", start), slog.Int("emails", len(emails)))
+	}
+	for i := start; i < len(emails); i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := deliverEmail(to, emails[i]); err != nil {
+			return fmt.Errorf("sending email %d of %d: %w", i+1, len(emails), err)
+		}
+		if h.job != nil {
+			h.job.Sent = i + 1
+			if err := h.srv.jobs.save(*h.job); err != nil {
+				h.log.Warn("saving push progress", slog.String("error", err.Error()))
+			}
+		}
+	}
+	return nil
+}
+
+// refChange is the push in the format of a post-receive hook's input.
+func (p pushInfo) refChange() string {
+	return fmt.Sprintf("%s %s %s", p.Before, p.After, p.Ref)
+}
+
+// sendEmails reads the repo's config, generates the emails for the push, and
+// sends them. It returns how many emails the push has.
+func (h PushHandler) sendEmails(ctx context.Context, gitDir string, auth *gitAuth, push pushInfo) (int, error) {
+	config, err := getConfig(gitDir)
+	if err != nil {
+		return 0, fmt.Errorf("could not get config for %s: %s", h.repo, err)
+	}
+	recipients, err := h.verifiedAddresses(config.MailingList)
+	if err != nil {
+		return 0, err
+	}
+	if len(recipients) == 0 {
+		h.log.Info("no confirmed recipients")
+		return 0, nil
+	}
+	if isForcePush(gitDir, push) {
+		h.log.Info("force push", slog.String("push", push.refChange()))
+	}
+	emails, err := generateEmails(ctx, gitDir, auth, config, headerAddresses(recipients), push)
+	var me multimailError
+	if errors.As(err, &me) {
+		h.log.Error("git_multimail_wrapper.py failed",
+			slog.String("push", push.refChange()),
+			slog.String("stdout", me.stdout),
+			slog.String("stderr", me.stderr))
+	}
+	if err != nil {
+		return 0, err
 	}
-	return err
+	return len(emails), h.deliverEmails(ctx, envelopeAddresses(recipients), emails)
 }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v62/github"
+)
+
+// failure notifications
+//
+// When the emails for a push can't be sent (say, because of a broken config or
+// a rejected address), the people who set up the repo are told: by email to
+// the config's admin address, and optionally with a GitHub issue and a
+// status on the pushed commit. The email and issue are only sent once a day
+// for the same error, so a broken config doesn't spam.
+
+// failureNoticeInterval is how long until the same failure is reported again.
+const failureNoticeInterval = 24 * time.Hour
+
+// statusContext identifies the bot's commit statuses.
+const statusContext = "commit-emails"
+
+func failureMail(to []string, repo string, push pushInfo, pushErr error) []byte {
+	body := fmt.Sprintf(`commit-email-bot could not send the commit emails for a push to %s
+(%s, %.8s..%.8s):
+
+%s
+
+Emails will resume with the next push once this is fixed. You won't be
+notified about this error again for a day.
+`, repo, push.Ref, push.Before, push.After, pushErr)
+	return composeMail(to, fmt.Sprintf("Commit emails failed for %s", repo), body)
+}
+
+// failureKey identifies a failure for deciding whether it was already
+// reported. A failed git command is identified without its arguments, which
+// can include a temporary directory that's new for every push.
+func failureKey(err error) string {
+	var ge gitError
+	if !errors.As(err, &ge) || len(ge.args) == 0 {
+		return err.Error()
+	}
+	stderr := ge.stderr
+	for _, arg := range ge.args {
+		if filepath.IsAbs(arg) {
+			stderr = strings.ReplaceAll(stderr, arg, "<path>")
+		}
+	}
+	return fmt.Sprintf("git %s failed: %s: %q", ge.args[0], ge.state, stderr)
+}
+
+// truncate shortens s to at most n bytes, for GitHub fields with a limit.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
+
+// postStatus sets the bot's commit status on the pushed commit.
+func postStatus(ctx context.Context, client *github.Client, ev *github.PushEvent, state string, description string) error {
+	_, _, err := client.Repositories.CreateStatus(ctx,
+		ev.GetRepo().GetOwner().GetLogin(), ev.GetRepo().GetName(), ev.GetAfter(),
+		&github.RepoStatus{
+			State:       github.String(state),
+			Context:     github.String(statusContext),
+			Description: github.String(truncate(description, 140)),
+		})
+	return err
+}
+
+// notifyFailure reports that sending emails for a push failed. client and ev
+// are nil for pushes that didn't come from GitHub, which only get emails. The
+// config is read from gitDir, which might only have an older version of the
+// repo if fetching the push failed.
+func (h PushHandler) notifyFailure(ctx context.Context, gitDir string, client *github.Client, ev *github.PushEvent, push pushInfo, pushErr error) {
+	if h.srv.jobs.interrupted() {
+		// the push will be resumed
+		return
+	}
+	config, ok := reportConfig(gitDir, push.Before)
+	if !ok {
+		h.log.Info("no config to report failure to")
+		return
+	}
+	// a status is attached to the commit, so it's always set (unless the
+	// result of every push is already reported)
+	if client != nil && config.Failures.Status && config.GitHub.Report == "" && push.After != zeroSha {
+		if err := postStatus(ctx, client, ev, "error", pushErr.Error()); err != nil {
+			h.log.Warn("setting failure status", slog.String("error", err.Error()))
+		}
+	}
+	wantIssue := client != nil && config.Failures.Issue
+	if config.Admin == "" && !wantIssue {
+		return
+	}
+	key := failureKey(pushErr)
+	if h.srv.db.FailureNotified(h.repo, key, failureNoticeInterval) {
+		h.log.Info("failure already reported")
+		return
+	}
+	// the notice is only recorded once someone has actually been told, so
+	// a failure to deliver it is retried with the next failed push
+	delivered := false
+	if config.Admin != "" {
+		delivered = h.emailFailure(config.Admin, push, pushErr)
+	}
+	if wantIssue {
+		issue, _, err := client.Issues.Create(ctx,
+			ev.GetRepo().GetOwner().GetLogin(), ev.GetRepo().GetName(),
+			&github.IssueRequest{
+				Title: github.String("Commit emails could not be sent"),
+				Body: github.String(fmt.Sprintf("commit-email-bot could not send the commit emails for the push to `%s` (%s):\n\n```\n%s\n```\n\nYou won't be notified about this error again for a day.",
+					push.Ref, push.After, pushErr)),
+			})
+		if err != nil {
+			h.log.Warn("opening failure issue", slog.String("error", err.Error()))
+		} else {
+			h.log.Info("opened failure issue", slog.Int("issue", issue.GetNumber()))
+			delivered = true
+		}
+	}
+	if delivered {
+		h.srv.db.AddFailureNotice(h.repo, key)
+	}
+}
+
+// emailFailure emails the failure to the admin address, and reports whether
+// it was sent.
+func (h PushHandler) emailFailure(admin string, push pushInfo, pushErr error) bool {
+	// admins are confirmed like any other recipient, so the setting can't be
+	// used to send mail to strangers
+	to, err := h.verifiedAddresses(admin)
+	if err != nil {
+		h.log.Warn("checking admin address", slog.String("error", err.Error()))
+		return false
+	}
+	if len(to) == 0 {
+		return false
+	}
+	msg := failureMail(headerAddresses(to), h.repo, push, pushErr)
+	if err := sendMail(envelopeAddresses(to), msg); err != nil {
+		h.log.Warn("emailing failure", slog.String("error", err.Error()))
+		return false
+	}
+	h.log.Info("emailed failure", slog.String("admin", admin))
+	return true
+}
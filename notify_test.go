@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tchajed/commit-emails-bot/stats"
+)
+
+// TestFailureNoticeAfterDelivery checks that a failure only counts as
+// reported once the admin has actually been emailed.
+func TestFailureNoticeAfterDelivery(t *testing.T) {
+	requireGit(t)
+	repo := newFixtureRepo(t)
+	if err := os.MkdirAll(filepath.Join(repo.dir, ".github"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := "to = \"commits@example.com\"\nadmin = \"admin@example.com\"\n"
+	if err := os.WriteFile(filepath.Join(repo.dir, ".github", "commit-emails.toml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	after := repo.commit("Config")
+
+	savedCfg, savedStdout := Cfg, mailStdout
+	t.Cleanup(func() {
+		Cfg, mailStdout = savedCfg, savedStdout
+	})
+	Cfg.SmtpPassword = ""
+	var out bytes.Buffer
+	mailStdout = &out
+
+	db, err := stats.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := newJobTracker(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := PushHandler{srv: Server{db: db, jobs: jobs}, repo: "alice/proj", log: slog.Default()}
+	push := pushInfo{Before: zeroSha, After: after, Ref: "refs/heads/main"}
+	pushErr := errors.New("invalid address in to")
+	gitDir := repo.gitDir()
+
+	// the admin hasn't confirmed, so only a confirmation goes out
+	h.notifyFailure(context.Background(), gitDir, nil, nil, push, pushErr)
+	if strings.Contains(out.String(), "Commit emails failed") {
+		t.Fatalf("failure emailed to an unconfirmed admin:\n%s", out.String())
+	}
+	if db.FailureNotified(h.repo, pushErr.Error(), time.Hour) {
+		t.Fatal("failure recorded as reported without reaching anyone")
+	}
+
+	m := regexp.MustCompile(`token=([0-9a-f]+)`).FindStringSubmatch(out.String())
+	if m == nil {
+		t.Fatalf("no confirmation link sent:\n%s", out.String())
+	}
+	if _, _, err := db.VerifyRecipient(m[1]); err != nil {
+		t.Fatal(err)
+	}
+	h.notifyFailure(context.Background(), gitDir, nil, nil, push, pushErr)
+	if !strings.Contains(out.String(), "Commit emails failed") {
+		t.Fatalf("failure not emailed to the confirmed admin:\n%s", out.String())
+	}
+	if !db.FailureNotified(h.repo, pushErr.Error(), time.Hour) {
+		t.Error("delivered failure notice wasn't recorded")
+	}
+}
+
+// TestFailureKeyIgnoresTempDir checks that clone failures, whose commands
+// name a new temporary directory each time, count as the same failure.
+func TestFailureKeyIgnoresTempDir(t *testing.T) {
+	requireGit(t)
+	gitDir := filepath.Join(t.TempDir(), "proj.git")
+	missing := filepath.Join(t.TempDir(), "missing.git")
+	err1 := gitClone(context.Background(), missing, gitDir, nil, cloneFull)
+	err2 := gitClone(context.Background(), missing, gitDir, nil, cloneFull)
+	if err1 == nil || err2 == nil {
+		t.Fatal("cloning a missing repo succeeded")
+	}
+	if err1.Error() == err2.Error() {
+		t.Fatalf("clone errors don't name their temporary directories: %v", err1)
+	}
+	if failureKey(err1) != failureKey(err2) {
+		t.Errorf("clone failures have different keys:\n%s\n%s", failureKey(err1), failureKey(err2))
+	}
+
+	db, err := stats.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.AddFailureNotice("alice/proj", failureKey(err1))
+	if !db.FailureNotified("alice/proj", failureKey(err2), time.Hour) {
+		t.Error("second clone failure wasn't recognized as already reported")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// recording webhook deliveries
+//
+// With RECORD_DELIVERIES set, every valid GitHub delivery is saved to
+// persist/deliveries in the YAML format that test-push replays, so a
+// production issue can be reproduced locally. Only the most recent deliveries
+// are kept.
+
+// redactedHeaders are not recorded, since they are derived from the webhook
+// secret (or would be credentials if GitHub ever sent them).
+var redactedHeaders = map[string]bool{
+	"X-Hub-Signature":     true,
+	"X-Hub-Signature-256": true,
+	"Authorization":       true,
+	"Cookie":              true,
+}
+
+type recordedDelivery struct {
+	Headers map[string]string `yaml:"headers"`
+	Payload string            `yaml:"payload"`
+}
+
+type deliveryRecorder struct {
+	dir  string
+	keep int
+
+	mu sync.Mutex
+}
+
+// newDeliveryRecorder returns nil (which records nothing) if keep is 0.
+func newDeliveryRecorder(persistPath string, keep int) (*deliveryRecorder, error) {
+	if keep <= 0 {
+		return nil, nil
+	}
+	dir := filepath.Join(persistPath, "deliveries")
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return nil, err
+	}
+	return &deliveryRecorder{dir: dir, keep: keep}, nil
+}
+
+// record saves a delivery and removes the oldest ones beyond the limit.
+func (r *deliveryRecorder) record(req *http.Request, delivery string, payload []byte) error {
+	if r == nil {
+		return nil
+	}
+	d := recordedDelivery{
+		Headers: map[string]string{"Request method": req.Method},
+		Payload: string(payload),
+	}
+	for key, vals := range req.Header {
+		// replaying sets the length of the (possibly edited) payload
+		if key == "Content-Length" {
+			continue
+		}
+		if redactedHeaders[key] {
+			d.Headers[key] = "redacted"
+			continue
+		}
+		d.Headers[key] = strings.Join(vals, ", ")
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(d); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// the timestamp prefix makes the files sort (and replay) in order
+	name := fmt.Sprintf("%s-%s.yaml", time.Now().UTC().Format("20060102T150405.000000000"), delivery)
+	if err := os.WriteFile(filepath.Join(r.dir, name), buf.Bytes(), 0660); err != nil {
+		return err
+	}
+	return r.prune()
+}
+
+func (r *deliveryRecorder) prune() error {
+	files, err := filepath.Glob(filepath.Join(r.dir, "*.yaml"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	for len(files) > r.keep {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
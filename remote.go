@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// pushes to repos without a GitHub App installation (GitLab, Gitea, and
+// plain git servers)
+//
+// There's no API to check for commit-emails.toml first, so these repos are
+// cloned and the config is read from the clone. The clones are kept in
+// persist/remote, apart from the GitHub clones in persist/repos, since a
+// generic push can name its repo anything.
+
+func remoteGitDir(persistPath string, repo string) string {
+	return filepath.Join(persistPath, "remote", filepath.FromSlash(repo))
+}
+
+// remotePush is a push to a repo the bot accesses only over git.
+type remotePush struct {
+	// Repo identifies the repo, including its host so that it's distinct
+	// from GitHub repos with the same name
+	Repo     string
+	CloneURL string
+	// Auth is nil for anonymous fetches
+	Auth  *gitAuth
+	Depth int
+	Info  pushInfo
+}
+
+// runRemoteJob tracks and runs a push from a webhook, and writes the
+// response.
+func (srv Server) runRemoteJob(w http.ResponseWriter, job pushJob, push remotePush, logger *slog.Logger) {
+	done, err := srv.jobs.start(job)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	err = srv.handleRemotePush(&job, push, logger)
+	srv.recordResult(job, err, logger)
+	done(err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, _ = w.Write([]byte("OK"))
+}
+
+func (srv Server) handleRemotePush(job *pushJob, push remotePush, logger *slog.Logger) error {
+	logger = logger.With(slog.String("repo", push.Repo))
+	ctx, cancel := srv.jobs.pushContext()
+	defer cancel()
+	h := PushHandler{
+		srv:  srv,
+		repo: push.Repo,
+		log:  logger,
+		job:  job,
+	}
+	err := h.remotePushHandler(ctx, push)
+	if err != nil {
+		err = fmt.Errorf("push handler failed: %s", err)
+		logger.Error("push handler", slog.String("error", err.Error()))
+		return err
+	}
+	logger.Info("push success",
+		slog.String("ref change", fmt.Sprintf("%s: %.8s -> %.8s", push.Info.Ref, push.Info.Before, push.Info.After)),
+	)
+	return nil
+}
+
+// remoteCloneMode is the clone mode for a remote repo. Without an API to
+// read the config before fetching, the repo's git.clone setting is read from
+// its existing clone, so the first clone uses the default.
+func remoteCloneMode(gitDir string) string {
+	if config, ok := reportConfig(gitDir, ""); ok && validCloneMode(config.Git.Clone) {
+		return config.Git.Clone
+	}
+	return Cfg.CloneMode
+}
+
+// checkServerConfig checks the <name>_URL setting for a GitLab or Gitea
+// server, which a <name>_TOKEN needs so that the token isn't sent to whatever
+// host a payload names.
+func checkServerConfig(name string, server string, token string) error {
+	if server == "" {
+		if token != "" {
+			return fmt.Errorf("%s_TOKEN is set without %s_URL (the server it's for)", name, name)
+		}
+		return nil
+	}
+	u, err := url.Parse(server)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("invalid %s_URL %s (should be like https://git.example.com)", name, server)
+	}
+	return nil
+}
+
+// checkCloneURL checks that a clone URL from a payload (named by field in
+// errors) is an https:// or ssh:// URL. Other transports (file://, ext::,
+// local paths, ...) would reach the bot's own machine.
+func checkCloneURL(field string, cloneURL string) error {
+	u, err := url.Parse(cloneURL)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", field, err)
+	}
+	if !(u.Scheme == "https" || u.Scheme == "ssh") || u.Host == "" {
+		return fmt.Errorf("%s must be an https:// or ssh:// URL", field)
+	}
+	return nil
+}
+
+// checkServerURL checks that a clone URL from a payload is on server, the
+// configured address of a GitLab or Gitea server. Any host is allowed if
+// server is empty.
+func checkServerURL(server string, cloneURL string) error {
+	if server == "" {
+		return nil
+	}
+	s, err := url.Parse(server)
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(cloneURL)
+	if err != nil || u.Scheme != s.Scheme || u.Host != s.Host {
+		return fmt.Errorf("clone URL %s is not on %s", cloneURL, server)
+	}
+	return nil
+}
+
+// validRepoName checks that a repo name from a payload is safe to use as a
+// path under the repos directory.
+func validRepoName(repo string) error {
+	if repo == "" || strings.HasPrefix(repo, "/") {
+		return fmt.Errorf("invalid repo name %q", repo)
+	}
+	for _, part := range strings.Split(repo, "/") {
+		if part == "" || part == "." || part == ".." || strings.HasSuffix(part, ".lock") {
+			return fmt.Errorf("invalid repo name %q", repo)
+		}
+	}
+	return nil
+}
+
+func (h PushHandler) remotePushHandler(ctx context.Context, push remotePush) error {
+	if err := validRepoName(push.Repo); err != nil {
+		return err
+	}
+	gitDir := remoteGitDir(Cfg.PersistPath, push.Repo)
+	unlock, err := h.srv.locks.lock(ctx, gitDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	opts := fetchOptions{
+		mode:  remoteCloneMode(gitDir),
+		ref:   push.Info.Ref,
+		depth: push.Depth,
+	}
+	if push.Info.Before != zeroSha {
+		opts.before = push.Info.Before
+	}
+	if push.Info.After != zeroSha {
+		opts.after = push.Info.After
+	}
+	if err := h.syncGitDir(ctx, gitDir, push.CloneURL, push.Auth, opts); err != nil {
+		h.notifyFailure(ctx, gitDir, nil, nil, push.Info, err)
+		return err
+	}
+	if _, err := getConfig(gitDir); errors.Is(err, MissingConfigError{}) {
+		h.log.Info("push to unconfigured repo")
+		return nil
+	}
+	if _, err := h.sendEmails(ctx, gitDir, push.Auth, push.Info); err != nil {
+		h.notifyFailure(ctx, gitDir, nil, nil, push.Info, err)
+		return err
+	}
+	h.srv.db.ClearFailureNotices(h.repo)
+	return nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-github/v62/github"
+)
+
+func gitlabPayload(cloneURL string) []byte {
+	payload, _ := json.Marshal(map[string]any{
+		"object_kind": "push",
+		"ref":         "refs/heads/main",
+		"project": map[string]any{
+			"path_with_namespace": "alice/proj",
+			"git_http_url":        cloneURL,
+			"visibility_level":    0,
+		},
+	})
+	return payload
+}
+
+func TestGitlabTokenOnlyForServer(t *testing.T) {
+	savedCfg := Cfg
+	t.Cleanup(func() { Cfg = savedCfg })
+	Cfg.GitlabToken = "glpat-secret"
+	Cfg.GitlabURL = "https://gitlab.example.com"
+
+	push, err := parseGitlabPush(gitlabPayload("https://gitlab.example.com/alice/proj.git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth := push.remote().Auth; auth == nil || auth.host != "gitlab.example.com" {
+		t.Errorf("push from GITLAB_URL got auth %+v", auth)
+	}
+	for _, cloneURL := range []string{
+		"https://attacker.example.com/alice/proj.git",
+		"http://gitlab.example.com/alice/proj.git",
+		"https://gitlab.example.com.attacker.example.com/alice/proj.git",
+	} {
+		if _, err := parseGitlabPush(gitlabPayload(cloneURL)); err == nil {
+			t.Errorf("push with clone URL %s was accepted", cloneURL)
+		}
+	}
+
+	// without GITLAB_URL (which startup requires with a token) pushes from any
+	// server are accepted, but never get the token
+	Cfg.GitlabURL = ""
+	push, err = parseGitlabPush(gitlabPayload("https://attacker.example.com/alice/proj.git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth := push.remote().Auth; auth != nil {
+		t.Errorf("push without GITLAB_URL got auth for %s", auth.host)
+	}
+}
+
+// localCloneURLs are clone URLs that would have the bot clone from its own
+// machine.
+var localCloneURLs = []string{
+	"file:///srv/git/proj.git",
+	"/srv/git/proj.git",
+	"ext::sh -c touch% pwned",
+}
+
+func TestGitlabLocalCloneURL(t *testing.T) {
+	savedCfg := Cfg
+	t.Cleanup(func() { Cfg = savedCfg })
+	for _, server := range []string{"", "https://gitlab.example.com"} {
+		Cfg.GitlabURL = server
+		for _, cloneURL := range localCloneURLs {
+			if _, err := parseGitlabPush(gitlabPayload(cloneURL)); err == nil {
+				t.Errorf("GITLAB_URL=%q: push with clone URL %s was accepted", server, cloneURL)
+			}
+		}
+	}
+}
+
+func TestGitlabAccount(t *testing.T) {
+	// namespace is the group's display name, which the deny list can't use
+	push, err := parseGitlabPush([]byte(`{"object_kind": "push", "project": {"path_with_namespace": "spam-group/sub/proj", "namespace": "Spam Group", "git_http_url": "https://gitlab.example.com/spam-group/sub/proj.git"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := push.account(); got != "spam-group" {
+		t.Errorf("account is %q, want spam-group", got)
+	}
+}
+
+func TestCheckServerConfig(t *testing.T) {
+	tests := []struct {
+		server, token string
+		ok            bool
+	}{
+		{"", "", true},
+		{"", "token", false},
+		{"https://gitlab.example.com", "token", true},
+		{"http://gitlab.example.com", "token", false},
+		{"gitlab.example.com", "", false},
+	}
+	for _, tt := range tests {
+		err := checkServerConfig("GITLAB", tt.server, tt.token)
+		if (err == nil) != tt.ok {
+			t.Errorf("checkServerConfig(%q, %q) = %v", tt.server, tt.token, err)
+		}
+	}
+}
+
+func giteaPayload(cloneURL string) []byte {
+	payload, _ := json.Marshal(map[string]any{
+		"ref": "refs/heads/main",
+		"repository": map[string]any{
+			"full_name": "alice/proj",
+			"clone_url": cloneURL,
+			"private":   true,
+		},
+	})
+	return payload
+}
+
+func TestGiteaTokenOnlyForServer(t *testing.T) {
+	savedCfg := Cfg
+	t.Cleanup(func() { Cfg = savedCfg })
+	Cfg.GiteaToken = "gitea-secret"
+	Cfg.GiteaURL = "https://git.example.com"
+
+	push, err := parseGiteaPush(giteaPayload("https://git.example.com/alice/proj.git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth := push.remote().Auth; auth == nil || auth.host != "git.example.com" {
+		t.Errorf("push from GITEA_URL got auth %+v", auth)
+	}
+	if _, err := parseGiteaPush(giteaPayload("https://attacker.example.com/alice/proj.git")); err == nil {
+		t.Error("push from another server was accepted")
+	}
+}
+
+func TestGiteaLocalCloneURL(t *testing.T) {
+	savedCfg := Cfg
+	t.Cleanup(func() { Cfg = savedCfg })
+	for _, server := range []string{"", "https://git.example.com"} {
+		Cfg.GiteaURL = server
+		for _, cloneURL := range localCloneURLs {
+			if _, err := parseGiteaPush(giteaPayload(cloneURL)); err == nil {
+				t.Errorf("GITEA_URL=%q: push with clone URL %s was accepted", server, cloneURL)
+			}
+		}
+	}
+}
+
+func TestGenericRepoURL(t *testing.T) {
+	payload := func(repoURL string) []byte {
+		payload, _ := json.Marshal(genericPush{RepoURL: repoURL, Ref: "refs/heads/main", Before: zeroSha, After: zeroSha})
+		return payload
+	}
+	for _, repoURL := range []string{
+		"https://git.example.com/proj.git",
+		"ssh://git@git.example.com/proj.git",
+	} {
+		if _, err := parseGenericPush(payload(repoURL)); err != nil {
+			t.Errorf("%s: %v", repoURL, err)
+		}
+	}
+	for _, repoURL := range append([]string{
+		"git@git.example.com:proj.git",
+		"http://git.example.com/proj.git",
+	}, localCloneURLs...) {
+		if _, err := parseGenericPush(payload(repoURL)); err == nil {
+			t.Errorf("repo_url %s was accepted", repoURL)
+		}
+	}
+
+	// a generic push can't name its repo after a GitHub clone
+	push, err := parseGenericPush([]byte(`{"repo_url": "https://git.example.com/proj.git", "repo": "github.com/alice/proj", "ref": "refs/heads/main", "before": "a", "after": "b"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ghDir := repoGitDir("persist", &github.PushEventRepository{FullName: github.String("alice/proj")})
+	if dir := remoteGitDir("persist", push.Repo); dir == ghDir {
+		t.Errorf("generic push clones into the GitHub repo's %s", dir)
+	}
+}
+
+func TestCloneURLChanged(t *testing.T) {
+	requireGit(t)
+	var origins []string
+	for _, name := range []string{"first", "second"} {
+		origin := newFixtureRepo(t)
+		origin.commit(name)
+		origins = append(origins, origin.dir)
+	}
+	h := PushHandler{log: slog.Default()}
+	gitDir := filepath.Join(t.TempDir(), "clone")
+	opts := fetchOptions{mode: cloneFull, ref: "refs/heads/main"}
+	for _, origin := range origins {
+		if err := h.syncGitDir(context.Background(), gitDir, origin, nil, opts); err != nil {
+			t.Fatal(err)
+		}
+		want := fixtureGit(t, origin, nil, "rev-parse", "HEAD")
+		if got := fixtureGit(t, gitDir, nil, "rev-parse", "refs/heads/main"); got != want {
+			t.Errorf("clone of %s has main at %s, want %s", origin, got, want)
+		}
+	}
+	if origin := gitOriginURL(gitDir); origin != origins[1] {
+		t.Errorf("clone's origin is %s, want %s", origin, origins[1])
+	}
+}
+
+func TestRemoteCloneMode(t *testing.T) {
+	requireGit(t)
+	savedCfg := Cfg
+	t.Cleanup(func() { Cfg = savedCfg })
+	Cfg.CloneMode = cloneFull
+	gitDir := filepath.Join(t.TempDir(), "clone")
+	if mode := remoteCloneMode(gitDir); mode != cloneFull {
+		t.Errorf("first clone uses %s, want the default", mode)
+	}
+
+	origin := newFixtureRepo(t)
+	if err := os.MkdirAll(filepath.Join(origin.dir, ".github"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := "to = \"commits@example.com\"\n[git]\nclone = \"partial\"\n"
+	if err := os.WriteFile(filepath.Join(origin.dir, ".github", "commit-emails.toml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	origin.commit("Config")
+	if err := gitClone(context.Background(), origin.dir, gitDir, nil, cloneFull); err != nil {
+		t.Fatal(err)
+	}
+	if mode := remoteCloneMode(gitDir); mode != clonePartial {
+		t.Errorf("repo with clone = \"partial\" uses %s", mode)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-github/v62/github"
+	"gopkg.in/yaml.v3"
+)
+
+// The render subcommand runs the email pipeline on a local repo, for trying
+// out changes to the emails without a server, GitHub, or SMTP.
+
+// deliveryFile is a webhook delivery saved as YAML, as used by test-push and
+// the files in test-pushes/.
+type deliveryFile struct {
+	Headers map[string]yaml.Node `yaml:"headers"`
+	Payload string               `yaml:"payload"`
+}
+
+func readDeliveryFile(name string) (*deliveryFile, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var d deliveryFile
+	if err := yaml.Unmarshal(data, &d); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", name, err)
+	}
+	return &d, nil
+}
+
+// header returns a header from the delivery, ignoring case.
+func (d *deliveryFile) header(key string) string {
+	for k, v := range d.Headers {
+		if strings.EqualFold(k, key) {
+			return v.Value
+		}
+	}
+	return ""
+}
+
+// pushInfo parses a GitHub push event from the delivery.
+func (d *deliveryFile) pushInfo() (pushInfo, error) {
+	if event := d.header("X-GitHub-Event"); event != "" && event != "push" {
+		return pushInfo{}, fmt.Errorf("delivery is a %s event, not a push", event)
+	}
+	var ev github.PushEvent
+	if err := json.Unmarshal([]byte(d.Payload), &ev); err != nil {
+		return pushInfo{}, fmt.Errorf("could not parse push event: %w", err)
+	}
+	return githubPushInfo(&ev), nil
+}
+
+// multimailSeparator brackets each email in git_multimail's --stdout output.
+var multimailSeparator = strings.Repeat("=", 75)
+
+// splitMultimailOutput splits the output of git_multimail --stdout into
+// individual messages.
+func splitMultimailOutput(out []byte) [][]byte {
+	var msgs [][]byte
+	var cur bytes.Buffer
+	flush := func() {
+		if len(bytes.TrimSpace(cur.Bytes())) > 0 {
+			msgs = append(msgs, bytes.Clone(cur.Bytes()))
+		}
+		cur.Reset()
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		if scanner.Text() == multimailSeparator {
+			flush()
+			continue
+		}
+		cur.Write(scanner.Bytes())
+		cur.WriteByte('\n')
+	}
+	flush()
+	return msgs
+}
+
+// renderEmails generates the emails for push in gitDir without sending them.
+// The recipients are everything in the config's list, verified or not.
+func renderEmails(gitDir string, config CommitEmailConfig, push pushInfo) ([][]byte, error) {
+	addrs, err := parseMailingList(config.MailingList)
+	if err != nil {
+		return nil, err
+	}
+	emails, err := generateEmails(context.Background(), gitDir, nil, config, headerAddresses(addrs), push)
+	var me multimailError
+	if errors.As(err, &me) {
+		return nil, fmt.Errorf("%w\n%s", err, me.stderr)
+	}
+	return emails, err
+}
+
+// localGitDir finds the git directory of a work tree or bare repo.
+func localGitDir(path string) (string, error) {
+	out, err := exec.Command("git", "-C", path, "rev-parse", "--absolute-git-dir").Output()
+	if err != nil {
+		return "", fmt.Errorf("%s is not a git repo: %w", path, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// resolveCommit expands a revision to a full commit id.
+func resolveCommit(gitDir string, rev string) (string, error) {
+	out, err := runGitCmd(gitDir, nil, "rev-parse", "--verify", "--end-of-options", rev+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("unknown revision %s: %w", rev, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func renderMain(args []string) {
+	fs := flag.NewFlagSet("render", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: commit-email-bot render [flags] <repo>")
+		fmt.Fprintln(fs.Output(), "\nGenerates the emails for a push to a local repo, without sending them.")
+		fs.PrintDefaults()
+	}
+	ref := fs.String("ref", "", "pushed ref (defaults to the branch checked out)")
+	before := fs.String("before", "", "commit before the push (or zeros for a new ref)")
+	after := fs.String("after", "", "commit after the push (defaults to -ref)")
+	pushFile := fs.String("push", "", "take the push from a test-push YAML file instead")
+	configFile := fs.String("config", "", "use this commit-emails.toml instead of the one committed at HEAD")
+	outDir := fs.String("out", "", "write each email to a .eml file in this directory (default stdout)")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	gitDir, err := localGitDir(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var push pushInfo
+	if *pushFile != "" {
+		d, err := readDeliveryFile(*pushFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		push, err = d.pushInfo()
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		if *ref == "" {
+			out, err := runGitCmd(gitDir, nil, "symbolic-ref", "HEAD")
+			if err != nil {
+				log.Fatal("-ref is required when HEAD is detached")
+			}
+			*ref = strings.TrimSpace(string(out))
+		}
+		if !strings.HasPrefix(*ref, "refs/") {
+			*ref = "refs/heads/" + *ref
+		}
+		if *after == "" {
+			*after = *ref
+		}
+		if *before == "" {
+			log.Fatal("-before is required")
+		}
+		push.Ref = *ref
+		if push.After, err = resolveCommit(gitDir, *after); err != nil {
+			log.Fatal(err)
+		}
+		push.Before = zeroSha
+		if strings.Trim(*before, "0") != "" {
+			if push.Before, err = resolveCommit(gitDir, *before); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	var config CommitEmailConfig
+	if *configFile != "" {
+		text, err := os.ReadFile(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config, err = parseConfig(text)
+		if err != nil {
+			log.Fatalf("%s: %v", *configFile, err)
+		}
+	} else {
+		config, err = getConfig(gitDir)
+		if err != nil {
+			log.Fatalf("could not get config: %v", err)
+		}
+	}
+
+	msgs, err := renderEmails(gitDir, config, push)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *outDir == "" {
+		for _, msg := range msgs {
+			fmt.Println(multimailSeparator)
+			os.Stdout.Write(msg)
+		}
+		return
+	}
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		log.Fatal(err)
+	}
+	for i, msg := range msgs {
+		name := filepath.Join(*outDir, fmt.Sprintf("%04d.eml", i+1))
+		if err := os.WriteFile(name, msg, 0644); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(name)
+	}
+}
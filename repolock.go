@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// per-repo locking
+//
+// Pushes to the same repo are serialized so they don't race on cloning and
+// fetching into the same bare repo. Within a process this is a mutex per repo;
+// across processes sharing a persist directory it's an flock on a file next to
+// the repo.
+
+type repoLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func newRepoLocks() *repoLocks {
+	return &repoLocks{locks: make(map[string]*sync.Mutex)}
+}
+
+func (l *repoLocks) get(gitDir string) *sync.Mutex {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	m, ok := l.locks[gitDir]
+	if !ok {
+		m = &sync.Mutex{}
+		l.locks[gitDir] = m
+	}
+	return m
+}
+
+// lock acquires exclusive access to gitDir, waiting until ctx is done.
+func (l *repoLocks) lock(ctx context.Context, gitDir string) (unlock func(), err error) {
+	m := l.get(gitDir)
+	// sync.Mutex can't be cancelled, so poll with TryLock
+	for !m.TryLock() {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for lock on %s: %w", gitDir, ctx.Err())
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	f, err := lockFile(ctx, gitDir+".lock")
+	if err != nil {
+		m.Unlock()
+		return nil, err
+	}
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+		m.Unlock()
+	}, nil
+}
+
+func lockFile(ctx context.Context, path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			f.Close()
+			return nil, fmt.Errorf("flock %s: %w", path, err)
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, fmt.Errorf("waiting for lock on %s: %w", path, ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
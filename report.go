@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/google/go-github/v62/github"
+)
+
+// reporting pushes on GitHub
+//
+// With github.report set in the config, the result of every push is shown on
+// the pushed commit, as a commit status or a check run: how many emails were
+// sent and to which list, or why they weren't.
+
+const (
+	reportStatus = "status"
+	reportCheck  = "check"
+)
+
+func reportDescription(sent int, list string, sendErr error) string {
+	if sendErr != nil {
+		return "Emails failed: " + sendErr.Error()
+	}
+	if sent == 0 {
+		return "No emails sent"
+	}
+	if sent == 1 {
+		return "Sent 1 email to " + list
+	}
+	return fmt.Sprintf("Sent %d emails to %s", sent, list)
+}
+
+// reportResult shows the result of sending emails on the pushed commit, if
+// the repo asked for it.
+func (h PushHandler) reportResult(ctx context.Context, gitDir string, client *github.Client, ev *github.PushEvent, sent int, sendErr error) {
+	if ev.GetAfter() == zeroSha {
+		return
+	}
+	config, ok := reportConfig(gitDir, ev.GetBefore())
+	if !ok || config.GitHub.Report == "" {
+		return
+	}
+	description := reportDescription(sent, config.MailingList, sendErr)
+	var err error
+	switch config.GitHub.Report {
+	case reportStatus:
+		state := "success"
+		if sendErr != nil {
+			state = "error"
+		}
+		err = postStatus(ctx, client, ev, state, description)
+	case reportCheck:
+		err = postCheckRun(ctx, client, ev, sendErr == nil, description)
+	default:
+		return
+	}
+	if err != nil {
+		h.log.Warn("reporting result", slog.String("report", config.GitHub.Report), slog.String("error", err.Error()))
+		return
+	}
+	h.log.Info("reported result", slog.String("report", config.GitHub.Report))
+}
+
+// postCheckRun creates a completed check run on the pushed commit.
+func postCheckRun(ctx context.Context, client *github.Client, ev *github.PushEvent, success bool, summary string) error {
+	conclusion, title := "success", "Commit emails sent"
+	if !success {
+		conclusion, title = "failure", "Commit emails failed"
+	}
+	_, _, err := client.Checks.CreateCheckRun(ctx,
+		ev.GetRepo().GetOwner().GetLogin(), ev.GetRepo().GetName(),
+		github.CreateCheckRunOptions{
+			Name:       statusContext,
+			HeadSHA:    ev.GetAfter(),
+			Status:     github.String("completed"),
+			Conclusion: github.String(conclusion),
+			Output: &github.CheckRunOutput{
+				Title:   github.String(title),
+				Summary: github.String(summary),
+			},
+		})
+	return err
+}
@@ -1,11 +1,15 @@
 package stats
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"github.com/google/go-github/v62/github"
 	_ "github.com/mattn/go-sqlite3"
 	"log/slog"
 	"path/filepath"
+	"time"
 )
 
 type Database struct {
@@ -37,9 +41,70 @@ func New(persistPath string) (Database, error) {
 	if err != nil {
 		return Database{nil}, err
 	}
+	_, err = db.Exec(`create table if not exists recipients (
+		repo_name text not null,
+		address text not null,
+		token text not null unique,
+		verified boolean not null default false,
+		created timestamp not null default current_timestamp,
+		primary key (repo_name, address)
+		)`)
+	if err != nil {
+		return Database{nil}, err
+	}
+	// sent records when the confirmation email went out; it was added later,
+	// when pending confirmations had been sent as soon as they were added
+	added, err := addColumn(db, "recipients", "sent", "timestamp")
+	if err != nil {
+		return Database{nil}, err
+	}
+	if added {
+		if _, err := db.Exec(`update recipients set sent = created where not verified`); err != nil {
+			return Database{nil}, err
+		}
+	}
+	_, err = db.Exec(`create table if not exists installation_errors (
+		installation_id integer not null,
+		repo_name text not null,
+		time timestamp not null default current_timestamp,
+		error text not null,
+		primary key (installation_id, repo_name)
+		)`)
+	if err != nil {
+		return Database{nil}, err
+	}
+	_, err = db.Exec(`create table if not exists repo_recoveries (
+		repo_name text not null,
+		time timestamp not null default current_timestamp,
+		reason text not null
+		)`)
+	if err != nil {
+		return Database{nil}, err
+	}
+	_, err = db.Exec(`create table if not exists failure_notices (
+		repo_name text not null,
+		error text not null,
+		time timestamp not null default current_timestamp,
+		primary key (repo_name, error)
+		)`)
+	if err != nil {
+		return Database{nil}, err
+	}
 	return Database{conn: db}, err
 }
 
+// addColumn adds a column to an existing table if it's missing, reporting
+// whether it did.
+func addColumn(db *sql.DB, table string, column string, typ string) (bool, error) {
+	var n int
+	err := db.QueryRow(`select count(*) from pragma_table_info(?) where name = ?`, table, column).Scan(&n)
+	if err != nil || n > 0 {
+		return false, err
+	}
+	_, err = db.Exec(fmt.Sprintf(`alter table %s add column %s %s`, table, column, typ))
+	return err == nil, err
+}
+
 func (db Database) AddInstallation(event *github.InstallationEvent) {
 	action := event.GetAction()
 	if action == "created" || action == "new_permissions_accepted" {
@@ -117,3 +182,175 @@ func (db Database) AddPush(event *github.PushEvent) {
 		slog.Warn("stats db error", slog.String("err", err.Error()), slog.String("table", "repo_stats"))
 	}
 }
+
+// AddInstallationError records the latest problem accessing a repo through an
+// installation (such as missing permissions), so it can be reported to the
+// installation's owner.
+func (db Database) AddInstallationError(installation int64, repo string, msg string) {
+	_, err := db.conn.Exec(`insert or replace into installation_errors
+	(installation_id, repo_name, error) values (?, ?, ?)`,
+		installation, repo, msg)
+	if err != nil {
+		slog.Warn("stats db error", slog.String("err", err.Error()), slog.String("table", "installation_errors"))
+	}
+}
+
+// InstallationErrors returns the recorded problems for an installation, by
+// repo.
+func (db Database) InstallationErrors(installation int64) (map[string]string, error) {
+	rows, err := db.conn.Query(`select repo_name, error from installation_errors
+where installation_id = ?`, installation)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	errs := make(map[string]string)
+	for rows.Next() {
+		var repo, msg string
+		if err := rows.Scan(&repo, &msg); err != nil {
+			return nil, err
+		}
+		errs[repo] = msg
+	}
+	return errs, rows.Err()
+}
+
+// ClearInstallationError removes the recorded problem for a repo once it can
+// be accessed again.
+func (db Database) ClearInstallationError(installation int64, repo string) {
+	_, err := db.conn.Exec(`delete from installation_errors
+where installation_id = ? and repo_name = ?`, installation, repo)
+	if err != nil {
+		slog.Warn("stats db error", slog.String("err", err.Error()), slog.String("table", "installation_errors"))
+	}
+}
+
+// AddRecovery records that a repo's clone was broken and had to be re-cloned.
+func (db Database) AddRecovery(repo string, reason string) {
+	_, err := db.conn.Exec(`insert into repo_recoveries
+	(repo_name, reason) values (?, ?)`,
+		repo, reason)
+	if err != nil {
+		slog.Warn("stats db error", slog.String("err", err.Error()), slog.String("table", "repo_recoveries"))
+	}
+}
+
+// FailureNotified reports whether the repo's admins were already told about
+// a push to repo failing with msg in the last interval.
+func (db Database) FailureNotified(repo string, msg string, interval time.Duration) bool {
+	var notified bool
+	err := db.conn.QueryRow(`select time > datetime('now', ?) from failure_notices
+where repo_name = ? and error = ?`,
+		fmt.Sprintf("-%d seconds", int64(interval.Seconds())), repo, msg).Scan(&notified)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		slog.Warn("stats db error", slog.String("err", err.Error()), slog.String("table", "failure_notices"))
+		return true
+	}
+	return notified
+}
+
+// AddFailureNotice records that the repo's admins were told about a push
+// failing with msg.
+func (db Database) AddFailureNotice(repo string, msg string) {
+	_, err := db.conn.Exec(`insert or replace into failure_notices
+	(repo_name, error) values (?, ?)`, repo, msg)
+	if err != nil {
+		slog.Warn("stats db error", slog.String("err", err.Error()), slog.String("table", "failure_notices"))
+	}
+}
+
+// ClearFailureNotices forgets the failures reported for a repo once a push
+// succeeds, so the next failure is reported right away.
+func (db Database) ClearFailureNotices(repo string) {
+	_, err := db.conn.Exec(`delete from failure_notices where repo_name = ?`, repo)
+	if err != nil {
+		slog.Warn("stats db error", slog.String("err", err.Error()), slog.String("table", "failure_notices"))
+	}
+}
+
+// RecipientStatus is the verification state of an email address for a repo.
+type RecipientStatus int
+
+const (
+	RecipientUnknown RecipientStatus = iota
+	RecipientPending
+	RecipientVerified
+)
+
+// GetRecipient looks up whether address has confirmed it wants emails for repo.
+func (db Database) GetRecipient(repo string, address string) (RecipientStatus, error) {
+	var verified bool
+	err := db.conn.QueryRow(`select verified from recipients
+where repo_name = ? and address = ?`, repo, address).Scan(&verified)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RecipientUnknown, nil
+	}
+	if err != nil {
+		return RecipientUnknown, err
+	}
+	if verified {
+		return RecipientVerified, nil
+	}
+	return RecipientPending, nil
+}
+
+// AddRecipient records an unconfirmed address along with the token that will
+// confirm it.
+func (db Database) AddRecipient(repo string, address string, token string) error {
+	_, err := db.conn.Exec(`insert into recipients
+	(repo_name, address, token) values (?, ?, ?)`,
+		repo, address, token)
+	return err
+}
+
+// UnsentConfirmation returns the token for a pending address whose
+// confirmation email hasn't gone out yet (because sending it failed or was
+// rate limited), or "" if there is none.
+func (db Database) UnsentConfirmation(repo string, address string) (string, error) {
+	var token string
+	err := db.conn.QueryRow(`select token from recipients
+where repo_name = ? and address = ? and not verified and sent is null`, repo, address).Scan(&token)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return token, err
+}
+
+// ConfirmationSent records that the confirmation email for address was sent.
+func (db Database) ConfirmationSent(repo string, address string) error {
+	_, err := db.conn.Exec(`update recipients set sent = current_timestamp
+where repo_name = ? and address = ?`, repo, address)
+	return err
+}
+
+// ConfirmationsSent counts the confirmation emails sent for repo in the last
+// interval.
+func (db Database) ConfirmationsSent(repo string, interval time.Duration) (int, error) {
+	var n int
+	err := db.conn.QueryRow(`select count(*) from recipients
+where repo_name = ? and sent > datetime('now', ?)`,
+		repo, fmt.Sprintf("-%d seconds", int64(interval.Seconds()))).Scan(&n)
+	return n, err
+}
+
+// PendingRecipient looks up the unconfirmed address a token would confirm.
+func (db Database) PendingRecipient(token string) (repo string, address string, err error) {
+	err = db.conn.QueryRow(`select repo_name, address from recipients
+where token = ? and not verified`, token).Scan(&repo, &address)
+	return
+}
+
+// VerifyRecipient marks the address with the given token as confirmed. It
+// returns the repo and address that were confirmed.
+func (db Database) VerifyRecipient(token string) (repo string, address string, err error) {
+	err = db.conn.QueryRow(`update recipients
+set verified = true
+where token = ?
+returning repo_name, address`, token).Scan(&repo, &address)
+	return
+}
+
+// Ping checks that the database is reachable.
+func (db Database) Ping(ctx context.Context) error {
+	return db.conn.PingContext(ctx)
+}
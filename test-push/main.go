@@ -1,12 +1,19 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 
 	"gopkg.in/yaml.v3"
@@ -33,37 +40,105 @@ func parseTestPush(fileName string) (*TestPush, error) {
 	return &testPush, nil
 }
 
-func main() {
-	fileName := flag.String("file", "", "push yaml file")
-	flag.Parse()
-
-	if *fileName == "" {
-		log.Fatal("file name must be provided")
-	}
+// signature computes a GitHub webhook signature header value, like
+// "sha256=<hex>".
+func signature(name string, h func() hash.Hash, secret []byte, payload []byte) string {
+	mac := hmac.New(h, secret)
+	mac.Write(payload)
+	return name + "=" + hex.EncodeToString(mac.Sum(nil))
+}
 
-	testPush, err := parseTestPush(*fileName)
-	if err != nil {
-		log.Fatal(err)
+// pushFiles expands the arguments into a list of YAML files, replacing each
+// directory with the files in it in lexical (and thus date) order.
+func pushFiles(args []string) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(arg, "*.yaml"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
 	}
+	return files, nil
+}
 
-	client := &http.Client{}
-	req, err := http.NewRequest("POST", "http://localhost:443/webhook", strings.NewReader(testPush.Payload))
+// send posts a test push to url, signed with secret if it's non-empty, and
+// returns the response.
+func send(client *http.Client, url string, secret []byte, testPush *TestPush) (*http.Response, error) {
+	payload := []byte(testPush.Payload)
+	req, err := http.NewRequest("POST", url, strings.NewReader(testPush.Payload))
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	for key, val := range testPush.Headers {
 		if key == "Request method" {
 			continue
 		}
+		// the recorded signatures are for the production secret
 		if key == "X-Hub-Signature" || key == "X-Hub-Signature-256" {
 			continue
 		}
 		req.Header.Add(key, val.Value)
 	}
-	resp, err := client.Do(req)
+	if len(secret) > 0 {
+		req.Header.Set("X-Hub-Signature", signature("sha1", sha1.New, secret, payload))
+		req.Header.Set("X-Hub-Signature-256", signature("sha256", sha256.New, secret, payload))
+	}
+	return client.Do(req)
+}
+
+func main() {
+	fileName := flag.String("file", "", "push yaml file (or pass files and directories as arguments)")
+	url := flag.String("url", "http://localhost:443/webhook", "webhook URL to post to")
+	secretFlag := flag.String("secret", "", "webhook secret to sign payloads with (defaults to $WEBHOOK_SECRET)")
+	expect := flag.Int("expect", 0, "fail unless every response has this status code")
+	flag.Parse()
+
+	args := flag.Args()
+	if *fileName != "" {
+		args = append([]string{*fileName}, args...)
+	}
+	if len(args) == 0 {
+		log.Fatal("file name must be provided")
+	}
+	files, err := pushFiles(args)
 	if err != nil {
 		log.Fatal(err)
 	}
-	body, _ := io.ReadAll(resp.Body)
-	fmt.Printf("%v\n%s\n", resp.Status, string(body))
+	secret := *secretFlag
+	if secret == "" {
+		secret = os.Getenv("WEBHOOK_SECRET")
+	}
+
+	client := &http.Client{}
+	failed := 0
+	for _, name := range files {
+		testPush, err := parseTestPush(name)
+		if err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+		resp, err := send(client, *url, []byte(secret), testPush)
+		if err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		fmt.Printf("%s: %v\n%s\n", name, resp.Status, strings.TrimSpace(string(body)))
+		if *expect != 0 && resp.StatusCode != *expect {
+			fmt.Printf("%s: expected status %d\n", name, *expect)
+			failed++
+		}
+	}
+	if failed > 0 {
+		log.Fatalf("%d of %d pushes got an unexpected status", failed, len(files))
+	}
 }
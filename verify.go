@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tchajed/commit-emails-bot/stats"
+)
+
+// recipient verification
+//
+// Anyone can commit a commit-emails.toml listing arbitrary addresses, so the
+// bot only sends commit emails to addresses that have clicked a confirmation
+// link. The first time an address shows up for a repo it gets a one-time
+// confirmation email; until it's confirmed, it is dropped from the mailing
+// list. The link opens a page with a button, since mail scanners and link
+// previews follow links on their own, and only the button's POST confirms.
+// A confirmation that couldn't be sent is retried on the next push, and each
+// repo can only trigger a few confirmation emails an hour.
+
+// maxConfirmationsPerHour limits the confirmation emails for one repo.
+const maxConfirmationsPerHour = 10
+
+func newVerifyToken() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func confirmationMail(repo string, address string, token string) []byte {
+	link := Cfg.BaseURL() + "/verify?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf(`The repository %s has configured commit-email-bot to send
+commit notifications to %s.
+
+To start receiving these emails, open this link and press Confirm:
+
+%s
+
+If you did not expect this, you can ignore this email and you won't
+receive anything further from this repository.
+`, repo, address, link)
+	return composeMail([]string{address},
+		fmt.Sprintf("Confirm commit emails for %s", repo),
+		body)
+}
+
+// verifiedAddresses filters the mailing list down to confirmed addresses,
+// sending confirmation emails to any new ones.
+func (h PushHandler) verifiedAddresses(list string) ([]*mail.Address, error) {
+	addrs, err := parseMailingList(list)
+	if err != nil {
+		return nil, err
+	}
+	var verified []*mail.Address
+	for _, addr := range addrs {
+		address := strings.ToLower(addr.Address)
+		status, err := h.srv.db.GetRecipient(h.repo, address)
+		if err != nil {
+			return nil, fmt.Errorf("looking up recipient: %w", err)
+		}
+		switch status {
+		case stats.RecipientVerified:
+			verified = append(verified, addr)
+		case stats.RecipientPending:
+			h.log.Info("skipping unconfirmed recipient", slog.String("address", address))
+			h.retryConfirmation(address)
+		case stats.RecipientUnknown:
+			h.requestConfirmation(address)
+		}
+	}
+	return verified, nil
+}
+
+func (h PushHandler) requestConfirmation(address string) {
+	token := newVerifyToken()
+	if err := h.srv.db.AddRecipient(h.repo, address, token); err != nil {
+		h.log.Error("adding recipient", slog.String("error", err.Error()))
+		return
+	}
+	h.sendConfirmation(address, token)
+}
+
+// retryConfirmation sends the confirmation for a pending address again if it
+// never went out.
+func (h PushHandler) retryConfirmation(address string) {
+	token, err := h.srv.db.UnsentConfirmation(h.repo, address)
+	if err != nil {
+		h.log.Error("looking up confirmation", slog.String("error", err.Error()))
+		return
+	}
+	if token != "" {
+		h.sendConfirmation(address, token)
+	}
+}
+
+func (h PushHandler) sendConfirmation(address string, token string) {
+	sent, err := h.srv.db.ConfirmationsSent(h.repo, time.Hour)
+	if err != nil {
+		h.log.Error("counting confirmations", slog.String("error", err.Error()))
+		return
+	}
+	if sent >= maxConfirmationsPerHour {
+		h.log.Warn("too many confirmations, will retry on a later push",
+			slog.String("address", address))
+		return
+	}
+	err = sendMail([]string{address}, confirmationMail(h.repo, address, token))
+	if err != nil {
+		h.log.Error("sending confirmation",
+			slog.String("address", address),
+			slog.String("error", err.Error()))
+		return
+	}
+	if err := h.srv.db.ConfirmationSent(h.repo, address); err != nil {
+		h.log.Error("recording confirmation", slog.String("error", err.Error()))
+	}
+	h.log.Info("sent confirmation", slog.String("address", address))
+}
+
+var confirmPage = template.Must(template.New("confirm").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Confirm commit emails</title></head>
+<body>
+<p>Send commit emails for <b>{{.Repo}}</b> to <b>{{.Address}}</b>?</p>
+<form method="post" action="/verify">
+<input type="hidden" name="token" value="{{.Token}}">
+<button type="submit">Confirm</button>
+</form>
+</body>
+</html>
+`))
+
+// verifyHandler shows the confirmation page for the link in a confirmation
+// email (GET) and confirms the address when its button is pressed (POST).
+func (srv Server) verifyHandler(w http.ResponseWriter, req *http.Request) {
+	token := req.FormValue("token")
+	if token == "" {
+		http.Error(w, "missing token", http.StatusBadRequest)
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		repo, address, err := srv.db.PendingRecipient(token)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "unknown or already used confirmation link", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.Error("look up recipient", slog.String("error", err.Error()))
+			http.Error(w, "could not look up confirmation", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		_ = confirmPage.Execute(w, map[string]string{"Repo": repo, "Address": address, "Token": token})
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	repo, address, err := srv.db.VerifyRecipient(token)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "unknown or expired confirmation link", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("verify recipient", slog.String("error", err.Error()))
+		http.Error(w, "could not confirm address", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("recipient confirmed",
+		slog.String("repo", repo),
+		slog.String("address", address))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = fmt.Fprintf(w, "Confirmed: %s will receive commit emails for %s.\n", address, repo)
+}
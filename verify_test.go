@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tchajed/commit-emails-bot/stats"
+)
+
+func TestVerifyNeedsPost(t *testing.T) {
+	db, err := stats.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := Server{db: db}
+	token := newVerifyToken()
+	if err := db.AddRecipient("alice/proj", "bob@example.com", token); err != nil {
+		t.Fatal(err)
+	}
+
+	// following the link (as a mail scanner would) only shows the page
+	rec := httptest.NewRecorder()
+	srv.verifyHandler(rec, httptest.NewRequest("GET", "/verify?token="+token, nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `method="post"`) {
+		t.Fatalf("GET returned %d:\n%s", rec.Code, rec.Body.String())
+	}
+	if status, _ := db.GetRecipient("alice/proj", "bob@example.com"); status != stats.RecipientPending {
+		t.Fatalf("GET confirmed the address (status %v)", status)
+	}
+
+	req := httptest.NewRequest("POST", "/verify", strings.NewReader(url.Values{"token": {token}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	srv.verifyHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST returned %d: %s", rec.Code, rec.Body.String())
+	}
+	if status, _ := db.GetRecipient("alice/proj", "bob@example.com"); status != stats.RecipientVerified {
+		t.Fatalf("POST did not confirm the address (status %v)", status)
+	}
+}
+
+func TestConfirmationRetried(t *testing.T) {
+	db, err := stats.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := newVerifyToken()
+	if err := db.AddRecipient("alice/proj", "bob@example.com", token); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := db.UnsentConfirmation("alice/proj", "bob@example.com"); got != token {
+		t.Fatalf("unsent confirmation = %q, want the token", got)
+	}
+	if err := db.ConfirmationSent("alice/proj", "bob@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := db.UnsentConfirmation("alice/proj", "bob@example.com"); got != "" {
+		t.Fatalf("sent confirmation is still unsent")
+	}
+	if n, _ := db.ConfirmationsSent("alice/proj", time.Hour); n != 1 {
+		t.Fatalf("confirmations sent = %d, want 1", n)
+	}
+}